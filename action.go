@@ -3,110 +3,248 @@ package epoll
 import (
 	"errors"
 	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
-func (ep *EP) accept(sequenceId int) {
+func (ep *EP) accept(l *Listener, sequenceId int) {
 	var err error
 	var fd int
+	var sa unix.Sockaddr
+	var ssl *SSL
+	var conn *Conn
+	var ip net.IP
+	var ok bool
+	var cb = ep.getCallbacks(l.Callbacks)
 	for {
-		fd, _, err = unix.Accept(ep.Fd)
+		l.fdLock.RLock()
+		if l.Fd < 0 {
+			l.fdLock.RUnlock()
+			break
+		}
+		fd, sa, err = unix.Accept(l.Fd)
+		l.fdLock.RUnlock()
 		if err == nil {
-			if ep.IsSSL {
-				var ssl = ep.newSSL(fd)
-				if ssl != nil {
-					ep.AddConnectionSSL(fd, ssl, sequenceId)
-				} else {
+			atomic.AddUint64(&ep.metrics.accepts, 1)
+			if ip, ok = ep.admit(cb, sa); !ok {
+				ep.rejectAccept(fd)
+				continue
+			}
+			ssl = nil
+			if l.IsSSL {
+				if ssl = ep.newSSL(l, fd); ssl == nil {
+					ep.releaseIP(ip)
 					ep.CloseFd(fd)
-					if ep.OnError != nil {
-						ep.OnError(fd, ERROR_SSL_CONNECTION_CREATE, ErrorSSLUnableCreate)
-					}
+					ep.countError(ERROR_SSL_CONNECTION_CREATE)
+					cb.error(newConnID(fd, 0), ERROR_SSL_CONNECTION_CREATE, ErrorSSLUnableCreate)
 					continue
 				}
-			} else {
-				ep.AddConnection(fd, sequenceId)
 			}
-			if err = ep.Add(fd); err == nil {
-				if ep.OnAccept != nil {
-					ep.OnAccept(fd)
+			conn = ep.newAcceptedConnection(l, fd, sa, ssl, sequenceId)
+			conn.peerIP = ip
+			conn.proxy = l.ProxyProtocol
+			if ssl != nil || l.ProxyProtocol {
+				// a plain connection waiting for its PROXY header counts as handshaking until it has been read
+				ep.startHandshake(fd, conn)
+			}
+			// conn belongs to the event loop once it is in the map, it may be closed and reset right away
+			var id, epfd = conn.ConnID(), ep.connEpfd(conn)
+			ep.Connections.Put(fd, conn)
+			if err = ep.addFd(epfd, fd); err == nil {
+				if ssl == nil && !l.ProxyProtocol {
+					cb.accept(id)
 				}
 			} else {
 				ep.DeleteConnection(fd)
-				if ep.OnError != nil {
-					ep.OnError(fd, ERROR_ADD_CONNECTION, err)
-				}
+				ep.countError(ERROR_ADD_CONNECTION)
+				cb.error(id, ERROR_ADD_CONNECTION, err)
 			}
 		} else {
 			if err != unix.EAGAIN && err != unix.EWOULDBLOCK {
-				if ep.OnError != nil {
-					ep.OnError(fd, ERROR_ACCEPT, err)
-				}
+				atomic.AddUint64(&ep.metrics.acceptErrors, 1)
+				ep.countError(ERROR_ACCEPT)
+				cb.error(newConnID(fd, 0), ERROR_ACCEPT, err)
 			}
 			break
 		}
 	}
 }
 
-func (ep *EP) read(fd int) {
+// returns false once the connection has been closed
+func (ep *EP) read(fd int) bool {
 	var err error
-	var sequenceId, ssl = ep.GetConnectionSequenceIdAndSSL(fd)
-	if sequenceId < 0 {
-		if ep.OnError != nil {
-			err = errors.New(fmt.Sprintf(ErrorTemplateNotFound, fd))
-			ep.InvokeError(-1, fd, ERROR_READ, err)
+	var conn *Conn
+	var sequenceId = -1
+	var proxy, seqpacket, ktlsRecv bool
+	// copied under the map lock, a worker may close and reset the connection meanwhile
+	ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+		var c, ok = value.(*Conn)
+		if ok {
+			c.Timestamp = time.Now().Unix()
+			conn, sequenceId = c, c.SequenceId
+			proxy, seqpacket, ktlsRecv = c.proxy, c.seqpacket, c.ktlsRecv
 		}
-		return
+	})
+	if conn == nil || sequenceId < 0 {
+		err = errors.New(fmt.Sprintf(ErrorTemplateNotFound, fd))
+		ep.reportError(-1, fd, ERROR_READ, err)
+		return false
 	}
+	conn.sslLock.Lock()
+	var ssl = conn.SSL
+	conn.sslLock.Unlock()
+	// the header comes before the TLS handshake
+	if proxy {
+		if atomic.LoadInt32(&conn.handshake) == HANDSHAKE_EXPIRED {
+			ep.dropConnection(fd, conn, CLOSE_REASON_PROXY, ERROR_PROXY_PROTOCOL, ErrorProxyHeaderTimeout)
+			return false
+		}
+		if done, open := ep.readProxyHeader(fd, conn); !done {
+			return open
+		}
+	}
+	if atomic.LoadInt32(&conn.handshake) != HANDSHAKE_NONE {
+		if done, open := ep.handshake(fd, conn); !done {
+			return open
+		}
+		// set by the handshake, under outLock as well
+		conn.outLock.Lock()
+		ktlsRecv = conn.ktlsRecv
+		conn.outLock.Unlock()
+	}
+	if atomic.LoadInt32(&conn.paused) != 0 {
+		return true
+	}
+	if atomic.LoadInt32(&ep.draining) != 0 {
+		// left unread, only pending writes keep the connection busy until Shutdown closes it
+		ep.setReadEvents(conn, false)
+		return true
+	}
+	atomic.AddUint64(&ep.metrics.readWakeups, 1)
 	var msg *[]byte
 	var readed, errno int
+	var plain, eof bool
 	for {
+		if ep.shouldPause(conn) {
+			ep.pauseRead(conn)
+			return true
+		}
 		msg, err = ep.GetBuffer()
 		if err != nil {
-			ep.InvokeError(sequenceId, fd, ERROR_POOL_BUFFER, err)
-			ep.CloseAction(sequenceId, fd)
-			break
+			ep.reportError(sequenceId, fd, ERROR_POOL_BUFFER, err)
+			ep.closeAction(CLOSE_REASON_ERROR, sequenceId, fd)
+			return false
+		}
+		plain = ssl == nil || ktlsRecv
+		if plain {
+			if seqpacket {
+				readed, eof, err = readPacket(fd, *msg)
+			} else {
+				readed, err = unix.Read(fd, *msg)
+				eof = readed == 0
+			}
+			// with kTLS records other than application data, e.g. alerts, fail with EIO and are left to OpenSSL
+			plain = ssl == nil || err != unix.EIO
 		}
-		if ep.IsSSL {
-			readed = sslRead(ssl.SSL, *msg, ep.ReadBuffer)
-			errno = GetSSLErrorNumber(ssl.SSL, readed)
+		if !plain {
+			conn.sslLock.Lock()
+			if conn.SSL != ssl {
+				// closed meanwhile, the SSL object went back to its pool
+				conn.sslLock.Unlock()
+				ep.PutBuffer(msg)
+				return false
+			}
+			readed, errno = sslRead(ssl.SSL, *msg, ep.ReadBuffer)
+			conn.sslLock.Unlock()
 			if errno == SSL_ERROR_NONE {
 				if readed > 0 {
-					ep.InvokeReceive(sequenceId, fd, msg, readed)
+					ep.countRead(readed)
+					if ep.MaxPendingReads > 0 {
+						atomic.AddInt32(&conn.pending, 1)
+					}
+					ep.invoke(sequenceId, ep.getRequestItemForReceive(conn, sequenceId, fd, msg, readed))
 				} else {
 					ep.PutBuffer(msg)
-					ep.CloseAction(sequenceId, fd)
-					break
+					ep.closeAction(CLOSE_REASON_PEER, sequenceId, fd)
+					return false
 				}
-			} else if errno == SSL_ERROR_ZERO_RETURN || errno == SSL_ERROR_SYSCALL || errno == SSL_ERROR_SSL {
+			} else if errno == SSL_ERROR_ZERO_RETURN {
 				ep.PutBuffer(msg)
-				ep.CloseAction(sequenceId, fd)
-				break
+				ep.closeAction(CLOSE_REASON_PEER, sequenceId, fd)
+				return false
+			} else if errno == SSL_ERROR_SYSCALL || errno == SSL_ERROR_SSL {
+				ep.PutBuffer(msg)
+				ep.closeAction(CLOSE_REASON_ERROR, sequenceId, fd)
+				return false
 			} else {
 				ep.PutBuffer(msg)
-				break
+				return true
 			}
-		} else {
-			readed, err = unix.Read(fd, *msg)
-			if err == nil {
-				if readed > 0 {
-					ep.InvokeReceive(sequenceId, fd, msg, readed)
-				} else {
-					ep.PutBuffer(msg)
-					ep.CloseAction(sequenceId, fd)
-					break
+		} else if err == nil {
+			if readed > 0 {
+				ep.countRead(readed)
+				if ep.MaxPendingReads > 0 {
+					atomic.AddInt32(&conn.pending, 1)
 				}
+				ep.invoke(sequenceId, ep.getRequestItemForReceive(conn, sequenceId, fd, msg, readed))
+			} else if !eof {
+				// an empty SEQPACKET message, there is nothing to pass on
+				ep.PutBuffer(msg)
 			} else {
 				ep.PutBuffer(msg)
-				break
+				ep.closeAction(CLOSE_REASON_PEER, sequenceId, fd)
+				return false
+			}
+		} else if err == ErrorMessageTruncated {
+			ep.PutBuffer(msg)
+			ep.reportError(sequenceId, fd, ERROR_READ, err)
+			ep.closeAction(CLOSE_REASON_ERROR, sequenceId, fd)
+			return false
+		} else {
+			ep.PutBuffer(msg)
+			return true
+		}
+	}
+}
+
+func (ep *EP) writable(fd int) {
+	var conn = ep.GetConnection(fd)
+	if conn != nil {
+		if atomic.LoadInt32(&conn.handshake) != HANDSHAKE_NONE {
+			if done, _ := ep.handshake(fd, conn); done {
+				ep.read(fd)
 			}
+			return
 		}
+		if !ep.flush(fd, conn) {
+			return
+		}
+		// under outLock, a worker may be closing and resetting the connection meanwhile
+		var req *Request
+		conn.outLock.Lock()
+		if conn.Fd == fd && ep.getCallbacks(conn.callbacks).hasEpollOut() {
+			req = ep.getRequestItemForEpollOut(conn, fd)
+		}
+		conn.outLock.Unlock()
+		if req != nil {
+			ep.invoke(-1, req)
+		}
+	} else if ep.Callbacks.hasEpollOut() {
+		ep.InvokeEpollOut(fd)
 	}
 }
 
 func (ep *EP) CloseAction(sequenceId int, fd int) error {
+	return ep.closeAction(CLOSE_REASON_APP, sequenceId, fd)
+}
+
+func (ep *EP) closeAction(reason CloseReason, sequenceId int, fd int) error {
 	var err error
 	if err = ep.Delete(fd); err == nil {
+		ep.countClose(reason)
 		ep.InvokeClose(sequenceId, fd)
 	}
 	return err
@@ -0,0 +1,127 @@
+package epoll
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func resolveSockaddr(host string, port int) (int, unix.Sockaddr, error) {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" {
+		return unix.AF_INET, &unix.SockaddrInet4{Port: port}, nil
+	}
+
+	var zone string
+	var i = strings.LastIndexByte(host, '%')
+	if i >= 0 {
+		zone = host[i+1:]
+		host = host[:i]
+	}
+
+	var ip = net.ParseIP(host)
+	if ip == nil {
+		return -1, nil, errors.New(fmt.Sprintf(ErrorTemplateInvalidHost, host))
+	}
+
+	return ipSockaddr(ip, zone, port, strings.Contains(host, ":"))
+}
+
+func ipSockaddr(ip net.IP, zone string, port int, forceIPv6 bool) (int, unix.Sockaddr, error) {
+	var ip4 = ip.To4()
+	if ip4 != nil && zone == "" && !forceIPv6 {
+		var addr = &unix.SockaddrInet4{Port: port}
+		copy(addr.Addr[:], ip4)
+		return unix.AF_INET, addr, nil
+	}
+
+	var addr = &unix.SockaddrInet6{Port: port}
+	copy(addr.Addr[:], ip.To16())
+	if zone != "" {
+		var iface, err = net.InterfaceByName(zone)
+		if err != nil {
+			return -1, nil, err
+		}
+		addr.ZoneId = uint32(iface.Index)
+	}
+	return unix.AF_INET6, addr, nil
+}
+
+func resolveNetworkSockaddr(network string, address string) (int, int, unix.Sockaddr, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		// IP literals only, a DNS lookup would block the caller of the non-blocking Dial
+		var host, service, err = net.SplitHostPort(address)
+		if err != nil {
+			return -1, -1, nil, err
+		}
+		var port int
+		if port, err = strconv.Atoi(service); err != nil || port < 0 || port > 0xffff {
+			return -1, -1, nil, errors.New(fmt.Sprintf(ErrorTemplateInvalidPort, service))
+		}
+		var zone string
+		if i := strings.LastIndexByte(host, '%'); i >= 0 {
+			host, zone = host[:i], host[i+1:]
+		}
+		var ip = net.ParseIP(host)
+		if ip == nil || (network == "tcp4" && (ip.To4() == nil || zone != "")) {
+			return -1, -1, nil, errors.New(fmt.Sprintf(ErrorTemplateInvalidHost, host))
+		}
+		var family int
+		var sa unix.Sockaddr
+		family, sa, err = ipSockaddr(ip, zone, port, network == "tcp6")
+		return family, unix.SOCK_STREAM, sa, err
+	case "unix":
+		return unix.AF_UNIX, unix.SOCK_STREAM, &unix.SockaddrUnix{Name: address}, nil
+	case "unixpacket":
+		return unix.AF_UNIX, unix.SOCK_SEQPACKET, &unix.SockaddrUnix{Name: address}, nil
+	}
+	return -1, -1, nil, errors.New(fmt.Sprintf(ErrorTemplateUnknownNetwork, network))
+}
+
+// nil for unix domain sockets
+func sockaddrIP(sa unix.Sockaddr) net.IP {
+	switch addr := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.IPv4(addr.Addr[0], addr.Addr[1], addr.Addr[2], addr.Addr[3])
+	case *unix.SockaddrInet6:
+		var ip = make(net.IP, net.IPv6len)
+		copy(ip, addr.Addr[:])
+		return ip
+	}
+	return nil
+}
+
+func sockaddrToAddr(sa unix.Sockaddr) net.Addr {
+	switch addr := sa.(type) {
+	case *unix.SockaddrInet4:
+		return &net.TCPAddr{IP: sockaddrIP(sa), Port: addr.Port}
+	case *unix.SockaddrInet6:
+		var zone string
+		if addr.ZoneId != 0 {
+			if iface, err := net.InterfaceByIndex(int(addr.ZoneId)); err == nil {
+				zone = iface.Name
+			}
+		}
+		return &net.TCPAddr{IP: sockaddrIP(sa), Port: addr.Port, Zone: zone}
+	case *unix.SockaddrUnix:
+		return &net.UnixAddr{Name: addr.Name, Net: "unix"}
+	}
+	return nil
+}
+
+func sockaddrFamily(sa unix.Sockaddr) int {
+	switch sa.(type) {
+	case *unix.SockaddrInet4:
+		return unix.AF_INET
+	case *unix.SockaddrInet6:
+		return unix.AF_INET6
+	case *unix.SockaddrUnix:
+		return unix.AF_UNIX
+	}
+	return unix.AF_UNSPEC
+}
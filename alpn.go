@@ -0,0 +1,53 @@
+package epoll
+
+import (
+	"errors"
+	"fmt"
+)
+
+// protocols offered with ALPN in order of preference, e.g. "h2", "http/1.1"
+// TLS listeners started afterwards offer them, also after a certificate reload
+// the crypto/tls backend may fail the handshake of a client that offers none of them
+func (ep *EP) SetALPN(protocols []string) error {
+	var p string
+	for _, p = range protocols {
+		if len(p) == 0 || len(p) > 255 {
+			return errors.New(fmt.Sprintf(ErrorTemplateALPNProtocol, p))
+		}
+	}
+	ep.sslOptions.alpn = append([]string(nil), protocols...)
+	return nil
+}
+
+// connections that negotiated protocol with ALPN are handled by callbacks instead of those of their listener
+// must be called before StartSSL or AddListenerSSL
+func (ep *EP) SetProtocolCallbacks(protocol string, callbacks *Callbacks) {
+	if ep.protocolCallbacks == nil {
+		ep.protocolCallbacks = make(map[string]*Callbacks)
+	}
+	ep.protocolCallbacks[protocol] = callbacks
+}
+
+// runs on the event loop once the handshake has completed, before OnAccept
+// and under the map lock, which bindRequest takes to read the callbacks
+func (ep *EP) routeProtocol(conn *Conn, protocol string) {
+	conn.Protocol = protocol
+	if protocol == "" {
+		return
+	}
+	if cb, ok := ep.protocolCallbacks[protocol]; ok {
+		conn.callbacks = cb
+	}
+}
+
+// the protocol negotiated with ALPN, empty until the handshake has completed or if none was negotiated
+func (ep *EP) GetConnectionProtocol(fd int) string {
+	var protocol string
+	ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+		var c, ok = value.(*Conn)
+		if ok {
+			protocol = c.Protocol
+		}
+	})
+	return protocol
+}
@@ -0,0 +1,72 @@
+package epoll
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"strings"
+	"testing"
+)
+
+// the protocol is picked by the order of the server, connections that negotiated one with callbacks of its own are handled by them
+func TestALPN(t *testing.T) {
+	var p = newTestPKI(t)
+	var cert, key, _ = p.issue(t, "server", []string{"alpn.test"}, false)
+	var ep = newEchoEP(t)
+	if err := ep.SetALPN([]string{"h2", "http/1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	var protocols = make(chan string, 1)
+	ep.OnAccept = func(fd int) { protocols <- ep.GetConnectionProtocol(fd) }
+	ep.SetProtocolCallbacks("h2", &Callbacks{
+		OnAccept:  ep.OnAccept,
+		OnReceive: func(fd int, msg []byte, n int) { ep.Send(fd, bytes.ToUpper(msg[:n])) },
+	})
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListenerSSL("127.0.0.1", 0, cert, key, nil)
+	})
+
+	var tests = []struct {
+		name     string
+		offered  []string
+		protocol string
+		reply    string
+	}{
+		{"h2", []string{"h2"}, "h2", "HELLO"},
+		{"http/1.1", []string{"http/1.1"}, "http/1.1", "hello"},
+		{"server preference", []string{"http/1.1", "h2"}, "h2", "HELLO"},
+		{"none offered", nil, "", "hello"},
+	}
+	for _, tt := range tests {
+		var c, err = dialTLS(t, addr, &tls.Config{ServerName: "alpn.test", RootCAs: p.pool(), NextProtos: tt.offered})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := c.ConnectionState().NegotiatedProtocol; got != tt.protocol {
+			t.Errorf("%s: client negotiated %q, want %q", tt.name, got, tt.protocol)
+		}
+		if got := receive(t, "OnAccept", protocols); got != tt.protocol {
+			t.Errorf("%s: GetConnectionProtocol %q, want %q", tt.name, got, tt.protocol)
+		}
+		c.Write([]byte("hello"))
+		var buf = make([]byte, 5)
+		if _, err = io.ReadFull(c, buf); err != nil || string(buf) != tt.reply {
+			t.Errorf("%s: reply %q %v, want %q", tt.name, buf, err, tt.reply)
+		}
+		c.Close()
+	}
+}
+
+func TestSetALPNInvalid(t *testing.T) {
+	var ep = newTestEP(t)
+	var protocols = [][]string{{""}, {"h2", strings.Repeat("x", 256)}}
+	var list []string
+	for _, list = range protocols {
+		if err := ep.SetALPN(list); err == nil {
+			t.Errorf("%q accepted", list)
+		}
+	}
+	if err := ep.SetALPN([]string{strings.Repeat("x", 255)}); err != nil {
+		t.Errorf("255 bytes: %v", err)
+	}
+}
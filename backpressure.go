@@ -0,0 +1,136 @@
+package epoll
+
+import (
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// reading a connection pauses while maxPending of its receive requests wait for the workers,
+// or while maxInflight requests of the EP are queued or running, 0 disables either limit
+// reading resumes once the count falls to half the limit, must be called before listening starts
+func (ep *EP) SetBackpressure(maxPending int, maxInflight int) {
+	ep.MaxPendingReads = maxPending
+	ep.MaxInflight = maxInflight
+}
+
+func (ep *EP) shouldPause(conn *Conn) bool {
+	if ep.MaxPendingReads > 0 && atomic.LoadInt32(&conn.pending) >= int32(ep.MaxPendingReads) {
+		return true
+	}
+	return ep.MaxInflight > 0 && atomic.LoadInt64(&ep.inflight) >= int64(ep.MaxInflight)
+}
+
+func (ep *EP) canResume(conn *Conn) bool {
+	if ep.MaxPendingReads > 0 && atomic.LoadInt32(&conn.pending) > int32(ep.MaxPendingReads/2) {
+		return false
+	}
+	return ep.MaxInflight <= 0 || atomic.LoadInt64(&ep.inflight) <= int64(ep.MaxInflight/2)
+}
+
+// runs on the event loop, EPOLLIN is removed until resumeReads picks the connection up again
+func (ep *EP) pauseRead(conn *Conn) {
+	var r = ep.reactorOf(conn)
+	atomic.StoreInt32(&conn.paused, 1)
+	atomic.AddInt32(&ep.pausedCount, 1)
+	atomic.AddUint64(&ep.metrics.readPauses, 1)
+	ep.setReadEvents(conn, false)
+
+	r.pauseLock.Lock()
+	r.paused = append(r.paused, conn.ConnID())
+	r.pauseLock.Unlock()
+
+	// the workers may have caught up before the connection was recorded
+	if ep.canResume(conn) {
+		wake(r.wakeFd)
+	}
+}
+
+// runs on the event loop when its wake fd fires, reads the connections that may continue
+func (ep *EP) resumeReads(r *reactor) {
+	var b [8]byte
+	unix.Read(r.wakeFd, b[:])
+
+	r.pauseLock.Lock()
+	var ids = r.paused
+	r.paused = nil
+	r.pauseLock.Unlock()
+
+	var id ConnID
+	var conn *Conn
+	var err error
+	var waiting []ConnID
+	for _, id = range ids {
+		if conn, err = ep.GetConnectionByID(id); err != nil {
+			atomic.AddInt32(&ep.pausedCount, -1)
+			continue
+		}
+		if !ep.canResume(conn) {
+			waiting = append(waiting, id)
+			continue
+		}
+		atomic.StoreInt32(&conn.paused, 0)
+		atomic.AddInt32(&ep.pausedCount, -1)
+		ep.setReadEvents(conn, true)
+		// edge triggered, data that arrived while paused raises no new event
+		ep.read(id.Fd())
+	}
+
+	if len(waiting) > 0 {
+		r.pauseLock.Lock()
+		r.paused = append(r.paused, waiting...)
+		r.pauseLock.Unlock()
+	}
+}
+
+// runs on the worker after a receive request of the connection has been handled
+func (ep *EP) receiveDone(id ConnID) {
+	var r *reactor
+	ep.updateByID(id, func(c *Conn) {
+		if atomic.AddInt32(&c.pending, -1) == int32(ep.MaxPendingReads/2) && atomic.LoadInt32(&c.paused) != 0 {
+			r = ep.reactorOf(c)
+		}
+	})
+	if r != nil {
+		wake(r.wakeFd)
+	}
+}
+
+// runs on the worker after any request, n is the number of requests left
+func (ep *EP) requestDone(n int64) {
+	if ep.MaxInflight > 0 && n == int64(ep.MaxInflight/2) && atomic.LoadInt32(&ep.pausedCount) > 0 {
+		var r *reactor
+		for _, r = range ep.reactors {
+			wake(r.wakeFd)
+		}
+	}
+}
+
+// keeps EPOLLOUT while writes or the handshake wait for it
+func (ep *EP) setReadEvents(conn *Conn, in bool) error {
+	conn.outLock.Lock()
+	defer conn.outLock.Unlock()
+	return ep.setEventsLocked(conn, in)
+}
+
+// runs with outLock held, which every change of the pending writes takes too
+func (ep *EP) setEventsLocked(conn *Conn, in bool) error {
+	var event = &unix.EpollEvent{
+		Events: EPOLL_EVENTS,
+		Fd:     int32(conn.Fd),
+	}
+	if in {
+		event.Events |= unix.EPOLLIN
+	}
+	if len(conn.outbound) > 0 || len(conn.files) > 0 || atomic.LoadInt32(&conn.handshake) == HANDSHAKE_WANT_WRITE {
+		event.Events |= unix.EPOLLOUT
+	}
+	return unix.EpollCtl(ep.connEpfd(conn), unix.EPOLL_CTL_MOD, conn.Fd, event)
+}
+
+func (ep *EP) reactorOf(conn *Conn) *reactor {
+	if conn.reactor != nil {
+		return conn.reactor
+	}
+	return ep.reactors[0]
+}
@@ -0,0 +1,72 @@
+package epoll
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// reading pauses once the workers fall behind by the limit and resumes with the data that arrived meanwhile
+func TestBackpressure(t *testing.T) {
+	var tests = []struct {
+		name        string
+		maxPending  int
+		maxInflight int
+	}{
+		{"pending", 2, 0},
+		{"inflight", 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ep = newTestEP(t)
+			ep.SetBackpressure(tt.maxPending, tt.maxInflight)
+			var gate = make(chan struct{})
+			var release = sync.OnceFunc(func() { close(gate) })
+			// the blocked workers would keep Shutdown waiting if the test fails
+			defer release()
+			var received = make(chan string, 3)
+			ep.OnReceive = func(fd int, msg []byte, n int) {
+				<-gate
+				received <- string(msg[:n])
+			}
+			var addr = serveTest(t, ep, func() (*Listener, error) {
+				return ep.AddListener("127.0.0.1", 0, nil)
+			})
+			var c, err = net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(testTimeout))
+
+			// one read each, the second one reaches the limit
+			var msg string
+			for _, msg = range []string{"a", "b"} {
+				var reads = ep.Stats().Reads + 1
+				c.Write([]byte(msg))
+				waitUntil(t, "the read of "+msg, func() bool { return ep.Stats().Reads == reads })
+			}
+			waitUntil(t, "the pause", func() bool { return ep.Stats().PausedReads == 1 })
+			c.Write([]byte("c"))
+			time.Sleep(50 * time.Millisecond)
+			if n := ep.Stats().Reads; n != 2 {
+				t.Fatalf("%d reads while paused, want 2", n)
+			}
+
+			release()
+			var got string
+			for len(got) < 3 {
+				got += receive(t, "OnReceive", received)
+			}
+			if got != "abc" {
+				t.Fatalf("received %q, want %q", got, "abc")
+			}
+			// reading "c" may have hit the limit again before the workers caught up
+			waitUntil(t, "the resume", func() bool { return ep.Stats().PausedReads == 0 })
+			if n := ep.Stats().ReadPauses; n == 0 || n > 2 {
+				t.Fatalf("%d pauses, want 1 or 2", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package epoll
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	DEFAULT_MAX_FRAME_SIZE = 1 << 20
+)
+
+// splits the received byte stream into frames, see OnMessage
+type Codec interface {
+	// returns the first complete frame in buf and the number of bytes it used,
+	// 0 bytes used means more data is needed, maxFrameSize 0 means unlimited
+	Decode(buf []byte, maxFrameSize int) ([]byte, int, error)
+	Encode(msg []byte) ([]byte, error)
+}
+
+// the built-in codecs reject a configuration that could never produce a frame, see SetCodec
+type codecValidator interface {
+	validate() error
+}
+
+// frames prefixed with their payload length in 1, 2, 4 or 8 bytes
+type LengthCodec struct {
+	Size  int
+	Order binary.ByteOrder // nil is big endian
+}
+
+func NewLengthCodec(size int, order binary.ByteOrder) *LengthCodec {
+	if order == nil {
+		order = binary.BigEndian
+	}
+	return &LengthCodec{Size: size, Order: order}
+}
+
+func (c *LengthCodec) validate() error {
+	switch c.Size {
+	case 1, 2, 4, 8:
+		return nil
+	}
+	return errors.New(fmt.Sprintf(ErrorTemplateLengthSize, c.Size))
+}
+
+func (c *LengthCodec) order() binary.ByteOrder {
+	if c.Order == nil {
+		return binary.BigEndian
+	}
+	return c.Order
+}
+
+func (c *LengthCodec) Decode(buf []byte, maxFrameSize int) ([]byte, int, error) {
+	if err := c.validate(); err != nil {
+		return nil, 0, err
+	}
+	if len(buf) < c.Size {
+		return nil, 0, nil
+	}
+	var length uint64
+	switch c.Size {
+	case 1:
+		length = uint64(buf[0])
+	case 2:
+		length = uint64(c.order().Uint16(buf))
+	case 4:
+		length = uint64(c.order().Uint32(buf))
+	case 8:
+		length = c.order().Uint64(buf)
+	default:
+		return nil, 0, errors.New(fmt.Sprintf(ErrorTemplateLengthSize, c.Size))
+	}
+	if (maxFrameSize > 0 && length > uint64(maxFrameSize)) || length > math.MaxInt32 {
+		return nil, 0, ErrorFrameTooLarge
+	}
+	var end = c.Size + int(length)
+	if len(buf) < end {
+		return nil, 0, nil
+	}
+	return buf[c.Size:end], end, nil
+}
+
+func (c *LengthCodec) Encode(msg []byte) ([]byte, error) {
+	var frame = make([]byte, c.Size+len(msg))
+	var length = uint64(len(msg))
+	switch c.Size {
+	case 1:
+		if length > math.MaxUint8 {
+			return nil, ErrorFrameTooLarge
+		}
+		frame[0] = byte(length)
+	case 2:
+		if length > math.MaxUint16 {
+			return nil, ErrorFrameTooLarge
+		}
+		c.order().PutUint16(frame, uint16(length))
+	case 4:
+		if length > math.MaxUint32 {
+			return nil, ErrorFrameTooLarge
+		}
+		c.order().PutUint32(frame, uint32(length))
+	case 8:
+		c.order().PutUint64(frame, length)
+	default:
+		return nil, errors.New(fmt.Sprintf(ErrorTemplateLengthSize, c.Size))
+	}
+	copy(frame[c.Size:], msg)
+	return frame, nil
+}
+
+// frames terminated by a delimiter, which is not part of the frame
+type DelimiterCodec struct {
+	Delimiter []byte
+	TrimCR    bool // drops a trailing '\r' from each frame
+}
+
+func NewDelimiterCodec(delimiter []byte) *DelimiterCodec {
+	return &DelimiterCodec{Delimiter: delimiter}
+}
+
+// lines ending with "\n" or "\r\n"
+func NewLineCodec() *DelimiterCodec {
+	return &DelimiterCodec{Delimiter: []byte{'\n'}, TrimCR: true}
+}
+
+func (c *DelimiterCodec) validate() error {
+	if len(c.Delimiter) == 0 {
+		return ErrorCodecDelimiter
+	}
+	return nil
+}
+
+func (c *DelimiterCodec) Decode(buf []byte, maxFrameSize int) ([]byte, int, error) {
+	if err := c.validate(); err != nil {
+		return nil, 0, err
+	}
+	var i = bytes.Index(buf, c.Delimiter)
+	if i < 0 {
+		if maxFrameSize > 0 && len(buf) > maxFrameSize+len(c.Delimiter) {
+			return nil, 0, ErrorFrameTooLarge
+		}
+		return nil, 0, nil
+	}
+	var frame = buf[:i]
+	if c.TrimCR && len(frame) > 0 && frame[len(frame)-1] == '\r' {
+		frame = frame[:len(frame)-1]
+	}
+	if maxFrameSize > 0 && len(frame) > maxFrameSize {
+		return nil, 0, ErrorFrameTooLarge
+	}
+	return frame, i + len(c.Delimiter), nil
+}
+
+func (c *DelimiterCodec) Encode(msg []byte) ([]byte, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	var frame = make([]byte, len(msg)+len(c.Delimiter))
+	copy(frame, msg)
+	copy(frame[len(msg):], c.Delimiter)
+	return frame, nil
+}
+
+// frames of exactly Size bytes
+type FixedCodec struct {
+	Size int
+}
+
+func NewFixedCodec(size int) *FixedCodec {
+	return &FixedCodec{Size: size}
+}
+
+func (c *FixedCodec) validate() error {
+	if c.Size <= 0 {
+		return errors.New(fmt.Sprintf(ErrorTemplateFixedSize, c.Size))
+	}
+	return nil
+}
+
+func (c *FixedCodec) Decode(buf []byte, maxFrameSize int) ([]byte, int, error) {
+	if err := c.validate(); err != nil {
+		return nil, 0, err
+	}
+	if maxFrameSize > 0 && c.Size > maxFrameSize {
+		return nil, 0, ErrorFrameTooLarge
+	}
+	if len(buf) < c.Size {
+		return nil, 0, nil
+	}
+	return buf[:c.Size], c.Size, nil
+}
+
+func (c *FixedCodec) Encode(msg []byte) ([]byte, error) {
+	if len(msg) != c.Size {
+		return nil, ErrorFrameSize
+	}
+	return msg, nil
+}
+
+// codec nil delivers raw reads to OnReceive, maxFrameSize 0 means unlimited
+// a LengthCodec size other than 1, 2, 4 or 8, an empty delimiter or a FixedCodec size below 1 is rejected
+func (ep *EP) SetCodec(codec Codec, maxFrameSize int) error {
+	if v, ok := codec.(codecValidator); ok {
+		if err := v.validate(); err != nil {
+			return err
+		}
+	}
+	ep.Codec = codec
+	ep.MaxFrameSize = maxFrameSize
+	return nil
+}
+
+// encodes msg with the codec of the EP and queues it with Send
+func (ep *EP) SendMessage(fd int, msg []byte) error {
+	if ep.Codec == nil {
+		return ep.Send(fd, msg)
+	}
+	var frame, err = ep.Codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	return ep.Send(fd, frame)
+}
+
+// runs on the worker of the connection, frames are only valid during OnMessage
+// the partial frame is taken from the Conn and put back under outLock, which resetConn holds too,
+// so a close meanwhile cannot hand it to the next connection using the Conn
+func (ep *EP) decode(sequenceId int, id ConnID, cb *Callbacks, msg []byte) {
+	var fd = id.Fd()
+	var conn, _ = ep.GetConnectionByID(id)
+	if conn == nil {
+		return
+	}
+
+	var inbound []byte
+	conn.outLock.Lock()
+	if conn.Generation != id.Generation() {
+		conn.outLock.Unlock()
+		return
+	}
+	inbound, conn.inbound = conn.inbound, nil
+	conn.outLock.Unlock()
+
+	var buf = msg
+	if len(inbound) > 0 {
+		inbound = append(inbound, msg...)
+		buf = inbound
+	}
+
+	var err error
+	var frame []byte
+	var n, used int
+	for used < len(buf) {
+		if frame, n, err = ep.Codec.Decode(buf[used:], ep.MaxFrameSize); err != nil || n == 0 {
+			break
+		}
+		used += n
+		cb.message(id, frame)
+	}
+
+	if err != nil {
+		ep.countError(ERROR_FRAME)
+		cb.error(id, ERROR_FRAME, err)
+		ep.closeAction(CLOSE_REASON_FRAME, sequenceId, fd)
+		return
+	}
+
+	if len(inbound) > 0 {
+		inbound = inbound[:copy(inbound, inbound[used:])]
+	} else if used < len(buf) {
+		inbound = append(inbound[:0], buf[used:]...)
+	}
+	conn.outLock.Lock()
+	if conn.Generation == id.Generation() {
+		conn.inbound = inbound
+	}
+	conn.outLock.Unlock()
+}
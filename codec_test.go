@@ -0,0 +1,167 @@
+package epoll
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCodecDecode(t *testing.T) {
+	var tests = []struct {
+		name  string
+		codec Codec
+		max   int
+		buf   string
+		frame string
+		used  int
+		err   error
+	}{
+		{"length 1", NewLengthCodec(1, nil), 0, "\x03abcd", "abc", 4, nil},
+		{"length 2 big endian", NewLengthCodec(2, nil), 0, "\x00\x03abc", "abc", 5, nil},
+		{"length 2 little endian", NewLengthCodec(2, binary.LittleEndian), 0, "\x03\x00abc", "abc", 5, nil},
+		{"length 4 nil order", &LengthCodec{Size: 4}, 0, "\x00\x00\x00\x02ab", "ab", 6, nil},
+		{"length 8", NewLengthCodec(8, nil), 0, "\x00\x00\x00\x00\x00\x00\x00\x01a", "a", 9, nil},
+		{"length empty frame", NewLengthCodec(2, nil), 0, "\x00\x00", "", 2, nil},
+		{"length partial header", NewLengthCodec(4, nil), 0, "\x00\x00", "", 0, nil},
+		{"length partial payload", NewLengthCodec(1, nil), 0, "\x05abc", "", 0, nil},
+		{"length too large", NewLengthCodec(2, nil), 4, "\x00\x05abcde", "", 0, ErrorFrameTooLarge},
+		{"length at the limit", NewLengthCodec(2, nil), 5, "\x00\x05abcde", "abcde", 7, nil},
+		{"length over int32", NewLengthCodec(8, nil), 0, "\x00\x00\x00\x01\x00\x00\x00\x00", "", 0, ErrorFrameTooLarge},
+		{"line", NewLineCodec(), 0, "abc\r\ndef\n", "abc", 5, nil},
+		{"line without CR", NewLineCodec(), 0, "abc\ndef", "abc", 4, nil},
+		{"line incomplete", NewLineCodec(), 0, "abc", "", 0, nil},
+		{"line too large", NewLineCodec(), 2, "abcdef", "", 0, ErrorFrameTooLarge},
+		{"line at the limit", NewLineCodec(), 3, "abc\r\n", "abc", 5, nil},
+		{"delimiter", NewDelimiterCodec([]byte("||")), 0, "a|b||c", "a|b", 5, nil},
+		{"delimiter keeps CR", NewDelimiterCodec([]byte("\n")), 0, "a\r\n", "a\r", 3, nil},
+		{"fixed", NewFixedCodec(3), 0, "abcd", "abc", 3, nil},
+		{"fixed partial", NewFixedCodec(3), 0, "ab", "", 0, nil},
+		{"fixed too large", NewFixedCodec(3), 2, "abc", "", 0, ErrorFrameTooLarge},
+	}
+	for _, tt := range tests {
+		var frame, used, err = tt.codec.Decode([]byte(tt.buf), tt.max)
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if used != tt.used || string(frame) != tt.frame {
+			t.Errorf("%s: frame %q used %d, want %q used %d", tt.name, frame, used, tt.frame, tt.used)
+		}
+	}
+}
+
+func TestCodecEncode(t *testing.T) {
+	var tests = []struct {
+		name  string
+		codec Codec
+		msg   string
+		frame string
+		err   error
+	}{
+		{"length 1", NewLengthCodec(1, nil), "abc", "\x03abc", nil},
+		{"length 2 big endian", NewLengthCodec(2, nil), "abc", "\x00\x03abc", nil},
+		{"length 4 little endian", NewLengthCodec(4, binary.LittleEndian), "ab", "\x02\x00\x00\x00ab", nil},
+		{"length 1 too large", NewLengthCodec(1, nil), string(make([]byte, 256)), "", ErrorFrameTooLarge},
+		{"line", NewLineCodec(), "abc", "abc\n", nil},
+		{"delimiter", NewDelimiterCodec([]byte("||")), "a", "a||", nil},
+		{"delimiter empty", NewDelimiterCodec(nil), "a", "", ErrorCodecDelimiter},
+		{"fixed", NewFixedCodec(2), "ab", "ab", nil},
+		{"fixed wrong size", NewFixedCodec(2), "abc", "", ErrorFrameSize},
+	}
+	for _, tt := range tests {
+		var frame, err = tt.codec.Encode([]byte(tt.msg))
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if string(frame) != tt.frame {
+			t.Errorf("%s: frame %q, want %q", tt.name, frame, tt.frame)
+		}
+	}
+}
+
+func TestSetCodec(t *testing.T) {
+	var tests = []struct {
+		name  string
+		codec Codec
+		ok    bool
+	}{
+		{"nil", nil, true},
+		{"length 2", NewLengthCodec(2, nil), true},
+		{"length 3", NewLengthCodec(3, nil), false},
+		{"length 0", &LengthCodec{}, false},
+		{"line", NewLineCodec(), true},
+		{"empty delimiter", NewDelimiterCodec([]byte{}), false},
+		{"fixed 1", NewFixedCodec(1), true},
+		{"fixed 0", NewFixedCodec(0), false},
+	}
+	var ep = newTestEP(t)
+	for _, tt := range tests {
+		var err = ep.SetCodec(tt.codec, 0)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// frames split across writes and several frames in one write reach OnMessage whole
+func TestCodecMessages(t *testing.T) {
+	var ep = newTestEP(t)
+	var codec = NewLengthCodec(2, nil)
+	if err := ep.SetCodec(codec, 16); err != nil {
+		t.Fatal(err)
+	}
+	var received = make(chan string, 8)
+	var failed = make(chan ErrorCode, 1)
+	ep.OnMessage = func(fd int, msg []byte) {
+		received <- string(msg)
+		ep.SendMessage(fd, bytes.ToUpper(msg))
+	}
+	ep.OnError = func(fd int, code ErrorCode, err error) { failed <- code }
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListener("127.0.0.1", 0, nil)
+	})
+
+	var c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(testTimeout))
+
+	c.Write([]byte("\x00\x05hel"))
+	time.Sleep(20 * time.Millisecond)
+	c.Write([]byte("lo\x00\x02ab\x00"))
+	time.Sleep(20 * time.Millisecond)
+	c.Write([]byte("\x01c"))
+	var want string
+	for _, want = range []string{"hello", "ab", "c"} {
+		if s := receive(t, "OnMessage", received); s != want {
+			t.Fatalf("message %q, want %q", s, want)
+		}
+	}
+	var reply = make([]byte, 3*2+8)
+	if _, err = io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "\x00\x05HELLO\x00\x02AB\x00\x01C" {
+		t.Fatalf("reply %q", reply)
+	}
+
+	// larger than the maximum frame size
+	c.Write([]byte("\x00\x20"))
+	select {
+	case code := <-failed:
+		if code != ERROR_FRAME {
+			t.Fatalf("error code %d, want ERROR_FRAME", code)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for the frame error")
+	}
+	if _, err = c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection still open after a frame error")
+	}
+}
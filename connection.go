@@ -3,6 +3,8 @@ package epoll
 import (
 	"errors"
 	"fmt"
+	"net"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -23,17 +25,49 @@ func connRecycleUpdate(ptr interface{}) {
 	}
 }
 
+// under outLock, so the event loop can still read the fields of a connection it is flushing while a worker closes it
 func resetConn(conn *Conn) {
+	conn.outLock.Lock()
+	defer conn.outLock.Unlock()
 	conn.Fd = -1
 	conn.SSL = nil
 	conn.Data = nil
 	conn.SequenceId = -1
+	conn.Family = 0
+	conn.Cred = nil
+	conn.RemoteAddr = nil
+	conn.LocalAddr = nil
 	conn.Timestamp = 0
 	conn.Status = 0
+	atomic.StoreInt32(&conn.handshake, HANDSHAKE_NONE)
+	conn.pending = 0
+	conn.peerIP = nil
+	conn.proxy = false
+	conn.ProxyTLVs = nil
+	conn.ServerName = ""
+	conn.peerCerts = nil
+	conn.Protocol = ""
+	conn.ktlsSend = false
+	conn.ktlsRecv = false
+	conn.seqpacket = false
+	conn.paused = 0
+	conn.inbound = nil
+	conn.Generation = 0
+	conn.outbound = nil
+	conn.files = nil
+	conn.sslWriteLen = 0
+	conn.Listener = nil
+	conn.callbacks = nil
+	conn.reactor = nil
+	if conn.hsTimer != nil {
+		conn.hsTimer.Stop()
+		conn.hsTimer = nil
+	}
 }
 
 func (ep *EP) getConn() *Conn {
 	var conn, err = ep.connPool.Get()
+	ep.metrics.connPool.get(err)
 	if err == nil {
 		return conn.(*Conn)
 	}
@@ -41,16 +75,21 @@ func (ep *EP) getConn() *Conn {
 }
 
 func (ep *EP) putConn(conn *Conn) {
+	ep.releaseIP(conn.peerIP)
 	resetConn(conn)
 	ep.connPool.PutWithId(conn, conn.Id)
 }
 
 func (ep *EP) Add(fd int) error {
+	return ep.addFd(ep.epfdOf(fd), fd)
+}
+
+func (ep *EP) addFd(epfd int, fd int) error {
 	var event = &unix.EpollEvent{
 		Events: EPOLL_EVENTS_EPOLLIN,
 		Fd:     int32(fd),
 	}
-	var err = unix.EpollCtl(ep.Epfd, unix.EPOLL_CTL_ADD, fd, event)
+	var err = unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, fd, event)
 	if err != nil {
 		return err
 	}
@@ -68,7 +107,7 @@ func (ep *EP) EnableEpollIn(fd int) error {
 		Events: EPOLL_EVENTS_EPOLLIN,
 		Fd:     int32(fd),
 	}
-	return unix.EpollCtl(ep.Epfd, unix.EPOLL_CTL_MOD, fd, event)
+	return unix.EpollCtl(ep.epfdOf(fd), unix.EPOLL_CTL_MOD, fd, event)
 }
 
 func (ep *EP) DisableEpollIn(fd int) error {
@@ -76,7 +115,7 @@ func (ep *EP) DisableEpollIn(fd int) error {
 		Events: EPOLL_EVENTS,
 		Fd:     int32(fd),
 	}
-	return unix.EpollCtl(ep.Epfd, unix.EPOLL_CTL_MOD, fd, event)
+	return unix.EpollCtl(ep.epfdOf(fd), unix.EPOLL_CTL_MOD, fd, event)
 }
 
 func (ep *EP) EnableEpollOut(fd int) error {
@@ -84,7 +123,7 @@ func (ep *EP) EnableEpollOut(fd int) error {
 		Events: EPOLL_EVENTS_EPOLLOUT,
 		Fd:     int32(fd),
 	}
-	return unix.EpollCtl(ep.Epfd, unix.EPOLL_CTL_MOD, fd, event)
+	return unix.EpollCtl(ep.epfdOf(fd), unix.EPOLL_CTL_MOD, fd, event)
 }
 
 func (ep *EP) DisableEpollOut(fd int) error {
@@ -92,11 +131,11 @@ func (ep *EP) DisableEpollOut(fd int) error {
 		Events: EPOLL_EVENTS_EPOLLIN,
 		Fd:     int32(fd),
 	}
-	return unix.EpollCtl(ep.Epfd, unix.EPOLL_CTL_MOD, fd, event)
+	return unix.EpollCtl(ep.epfdOf(fd), unix.EPOLL_CTL_MOD, fd, event)
 }
 
 func (ep *EP) Delete(fd int) error {
-	return unix.EpollCtl(ep.Epfd, unix.EPOLL_CTL_DEL, fd, nil)
+	return unix.EpollCtl(ep.epfdOf(fd), unix.EPOLL_CTL_DEL, fd, nil)
 }
 
 func (ep *EP) CloseFd(fd int) error {
@@ -105,13 +144,32 @@ func (ep *EP) CloseFd(fd int) error {
 
 // called externally
 func (ep *EP) EstablishConnection(fd int) error {
+	var _, err = ep.establishConnection(fd, 0)
+	return err
+}
+
+// generation 0 takes the next one, Dial passes the generation its handle was created with
+func (ep *EP) establishConnection(fd int, generation uint32) (int, error) {
 	var sequenceId = ep.GetSequenceId()
-	ep.AddConnection(fd, sequenceId)
+	var conn = ep.newConnection(fd, nil, sequenceId)
+	if generation != 0 {
+		conn.Generation = generation
+	}
+	conn.reactor = ep.nextReactor()
+	if sa, err := unix.Getpeername(fd); err == nil {
+		conn.Family = sockaddrFamily(sa)
+		conn.RemoteAddr = sockaddrToAddr(sa)
+	}
+	if conn.Family == unix.AF_UNIX {
+		conn.seqpacket = isSeqPacket(fd)
+	}
+	conn.LocalAddr = localAddr(fd)
+	ep.Connections.Put(fd, conn)
 	var err error
 	if err = ep.Add(fd); err != nil {
 		ep.DeleteConnection(fd)
 	}
-	return err
+	return sequenceId, err
 }
 
 // called externally
@@ -123,6 +181,7 @@ func (ep *EP) DestroyConnection(fd int) error {
 		return err
 	}
 	if err = ep.Delete(fd); err == nil {
+		ep.countClose(CLOSE_REASON_APP)
 		ep.InvokeClose(sequenceId, fd)
 	}
 	return err
@@ -141,18 +200,22 @@ func (ep *EP) CloseAll() {
 	var fd int
 	var conn *Conn
 	var ok1, ok2 bool
+	var reqs []*Request
 	ep.Connections.IterateAndUpdate(func(key interface{}, value interface{}) bool {
 		fd, ok1 = key.(int)
 		conn, ok2 = value.(*Conn)
 		if ok1 && ok2 {
-			ep.Delete(fd)
+			reqs = append(reqs, ep.abortFiles(conn)...)
+			// not Delete, epfdOf would take the map lock held here
+			unix.EpollCtl(ep.connEpfd(conn), unix.EPOLL_CTL_DEL, fd, nil)
 			ep.putConnSSL(conn)
 			ep.putConn(conn)
 			ep.CloseFd(fd)
 		}
 		return false
 	})
-	if ep.IsSSL {
+	ep.invokeRequests(reqs)
+	if ep.hasSSL() {
 		cMallocTrim()
 	}
 }
@@ -160,24 +223,55 @@ func (ep *EP) CloseAll() {
 func (ep *EP) DeleteConnection(fd int) bool {
 	var c *Conn
 	var ok bool
+	var reqs []*Request
 	ep.Connections.RemoveAndUpdate(fd, func(value interface{}) {
 		c, ok = value.(*Conn)
 		if ok {
+			reqs = ep.abortFiles(c)
 			ep.putConnSSL(c)
 			ep.putConn(c)
 		}
 	})
+	// not invoked under the map lock, see invoke
+	ep.invokeRequests(reqs)
 	return ok
 }
 
-func (ep *EP) AddConnection(fd int, sequenceId int) {
+func (ep *EP) newConnection(fd int, ssl *SSL, sequenceId int) *Conn {
 	var conn = ep.getConn()
 	conn.Fd = fd
+	conn.SSL = ssl
 	conn.SequenceId = sequenceId
+	conn.Generation = ep.nextGeneration()
 	conn.Data = nil
 	conn.Timestamp = time.Now().Unix()
 	conn.Status = 0
-	ep.Connections.Put(fd, conn)
+	return conn
+}
+
+// the fields are set before the Conn is put in the map, once it is there they only change
+// under the map lock, see readProxyHeader and handshake, so the getters read them under that lock
+func (ep *EP) newAcceptedConnection(l *Listener, fd int, sa unix.Sockaddr, ssl *SSL, sequenceId int) *Conn {
+	var conn = ep.newConnection(fd, ssl, sequenceId)
+	conn.Listener = l
+	conn.callbacks = l.Callbacks
+	if l.reactor != nil {
+		conn.reactor = l.reactor
+	} else {
+		conn.reactor = ep.nextReactor()
+	}
+	conn.Family = sockaddrFamily(sa)
+	conn.RemoteAddr = sockaddrToAddr(sa)
+	conn.LocalAddr = localAddr(fd)
+	if conn.Family == unix.AF_UNIX {
+		conn.Cred, _ = unix.GetsockoptUcred(fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+		conn.seqpacket = isSeqPacket(fd)
+	}
+	return conn
+}
+
+func (ep *EP) AddConnection(fd int, sequenceId int) {
+	ep.Connections.Put(fd, ep.newConnection(fd, nil, sequenceId))
 }
 
 func (ep *EP) GetConnectionSequenceId(fd int) int {
@@ -247,6 +341,50 @@ func (ep *EP) GetConnectionStatus(fd int) (int, bool) {
 	return -1, ok
 }
 
+// AF_INET, AF_INET6 or AF_UNIX
+func (ep *EP) GetConnectionFamily(fd int) (int, bool) {
+	var family = unix.AF_UNSPEC
+	var found bool
+	// read under the map lock, a closed Conn is reset for reuse
+	ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+		var c, ok = value.(*Conn)
+		if ok {
+			family, found = c.Family, true
+		}
+	})
+	return family, found
+}
+
+// the addresses are kept on the Conn when it is accepted or established, so this needs no syscall
+func (ep *EP) RemoteAddr(fd int) net.Addr {
+	var addr net.Addr
+	ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+		var c, ok = value.(*Conn)
+		if ok {
+			addr = c.RemoteAddr
+		}
+	})
+	return addr
+}
+
+func (ep *EP) LocalAddr(fd int) net.Addr {
+	var addr net.Addr
+	ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+		var c, ok = value.(*Conn)
+		if ok {
+			addr = c.LocalAddr
+		}
+	})
+	return addr
+}
+
+func localAddr(fd int) net.Addr {
+	if sa, err := unix.Getsockname(fd); err == nil {
+		return sockaddrToAddr(sa)
+	}
+	return nil
+}
+
 func (ep *EP) GetConnectionCount() int {
 	return ep.Connections.GetCount()
 }
@@ -0,0 +1,320 @@
+package epoll
+
+import (
+	"crypto/x509"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// handle of a connection, the fd in the low 32 bits and the generation of the Conn in the high 32 bits,
+// a handle kept after the connection was closed is rejected with ErrorConnIDStale even if the kernel reused the fd
+type ConnID uint64
+
+func newConnID(fd int, generation uint32) ConnID {
+	return ConnID(uint64(generation)<<32 | uint64(uint32(fd)))
+}
+
+func (id ConnID) Fd() int {
+	return int(int32(uint32(id)))
+}
+
+func (id ConnID) Generation() uint32 {
+	return uint32(id >> 32)
+}
+
+func (c *Conn) ConnID() ConnID {
+	return newConnID(c.Fd, c.Generation)
+}
+
+// 0 is never used, so a zero handle is always stale
+func (ep *EP) nextGeneration() uint32 {
+	for {
+		if g := atomic.AddUint32(&ep.generation, 1); g != 0 {
+			return g
+		}
+	}
+}
+
+// runs f under the lock of the connection map if the handle is still current
+func (ep *EP) updateByID(id ConnID, f func(c *Conn)) error {
+	var ok bool
+	ep.Connections.UpdateWithFunc(id.Fd(), func(value interface{}) {
+		var c *Conn
+		if c, ok = value.(*Conn); ok {
+			if ok = c.Generation == id.Generation(); ok {
+				c.Timestamp = time.Now().Unix()
+				if f != nil {
+					f(c)
+				}
+			}
+		}
+	})
+	if !ok {
+		return ErrorConnIDStale
+	}
+	return nil
+}
+
+func (ep *EP) GetConnID(fd int) (ConnID, bool) {
+	var id ConnID
+	var found bool
+	ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+		var c, ok = value.(*Conn)
+		if ok {
+			id, found = c.ConnID(), true
+		}
+	})
+	return id, found
+}
+
+func (ep *EP) GetConnectionByID(id ConnID) (*Conn, error) {
+	var conn *Conn
+	var err = ep.updateByID(id, func(c *Conn) {
+		conn = c
+	})
+	return conn, err
+}
+
+func (ep *EP) SetConnectionDataByID(id ConnID, data interface{}) error {
+	return ep.updateByID(id, func(c *Conn) {
+		c.Data = data
+	})
+}
+
+func (ep *EP) GetConnectionDataByID(id ConnID) (interface{}, error) {
+	var data interface{}
+	var err = ep.updateByID(id, func(c *Conn) {
+		data = c.Data
+	})
+	return data, err
+}
+
+func (ep *EP) UpdateConnectionDataWithFuncByID(id ConnID, updateDataFunc UpdateDataFunc) error {
+	return ep.updateByID(id, func(c *Conn) {
+		updateDataFunc(c.Data)
+	})
+}
+
+func (ep *EP) SetConnectionStatusByID(id ConnID, status int) error {
+	return ep.updateByID(id, func(c *Conn) {
+		c.Status = status
+	})
+}
+
+func (ep *EP) GetConnectionStatusByID(id ConnID) (int, error) {
+	var status = -1
+	var err = ep.updateByID(id, func(c *Conn) {
+		status = c.Status
+	})
+	return status, err
+}
+
+func (ep *EP) RemoteAddrByID(id ConnID) (net.Addr, error) {
+	var addr net.Addr
+	var err = ep.updateByID(id, func(c *Conn) {
+		addr = c.RemoteAddr
+	})
+	return addr, err
+}
+
+func (ep *EP) LocalAddrByID(id ConnID) (net.Addr, error) {
+	var addr net.Addr
+	var err = ep.updateByID(id, func(c *Conn) {
+		addr = c.LocalAddr
+	})
+	return addr, err
+}
+
+func (ep *EP) GetConnectionFamilyByID(id ConnID) (int, error) {
+	var family = unix.AF_UNSPEC
+	var err = ep.updateByID(id, func(c *Conn) {
+		family = c.Family
+	})
+	return family, err
+}
+
+func (ep *EP) GetConnectionListenerByID(id ConnID) (*Listener, error) {
+	var l *Listener
+	var err = ep.updateByID(id, func(c *Conn) {
+		l = c.Listener
+	})
+	return l, err
+}
+
+func (ep *EP) GetConnectionPeerCredByID(id ConnID) (*unix.Ucred, error) {
+	var cred *unix.Ucred
+	var err = ep.updateByID(id, func(c *Conn) {
+		cred = c.Cred
+	})
+	return cred, err
+}
+
+func (ep *EP) GetConnectionProxyTLVsByID(id ConnID) ([]ProxyTLV, error) {
+	var tlvs []ProxyTLV
+	var err = ep.updateByID(id, func(c *Conn) {
+		tlvs = c.ProxyTLVs
+	})
+	return tlvs, err
+}
+
+func (ep *EP) GetConnectionServerNameByID(id ConnID) (string, error) {
+	var name string
+	var err = ep.updateByID(id, func(c *Conn) {
+		name = c.ServerName
+	})
+	return name, err
+}
+
+func (ep *EP) GetConnectionProtocolByID(id ConnID) (string, error) {
+	var protocol string
+	var err = ep.updateByID(id, func(c *Conn) {
+		protocol = c.Protocol
+	})
+	return protocol, err
+}
+
+func (ep *EP) GetConnectionPeerCertificatesDERByID(id ConnID) ([][]byte, error) {
+	var certs [][]byte
+	var err = ep.updateByID(id, func(c *Conn) {
+		certs = c.peerCerts
+	})
+	return certs, err
+}
+
+func (ep *EP) GetConnectionPeerCertificatesByID(id ConnID) ([]*x509.Certificate, error) {
+	var ders, err = ep.GetConnectionPeerCertificatesDERByID(id)
+	if err != nil {
+		return nil, err
+	}
+	return parseCertificates(ders)
+}
+
+func (ep *EP) GetConnectionKTLSByID(id ConnID) (bool, bool, error) {
+	var send, recv bool
+	var err = ep.updateByID(id, func(c *Conn) {
+		send, recv = c.ktlsSend, c.ktlsRecv
+	})
+	return send, recv, err
+}
+
+func (ep *EP) GetSendQueueLengthByID(id ConnID) (int, error) {
+	var length int
+	var err = ep.updateByID(id, func(c *Conn) {
+		c.outLock.Lock()
+		length = len(c.outbound)
+		c.outLock.Unlock()
+	})
+	return length, err
+}
+
+func (ep *EP) EnableEpollOutByID(id ConnID) error {
+	var ctlErr error
+	var err = ep.updateByID(id, func(c *Conn) {
+		ctlErr = unix.EpollCtl(ep.connEpfd(c), unix.EPOLL_CTL_MOD, c.Fd, &unix.EpollEvent{
+			Events: EPOLL_EVENTS_EPOLLOUT,
+			Fd:     int32(c.Fd),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return ctlErr
+}
+
+func (ep *EP) DisableEpollOutByID(id ConnID) error {
+	var ctlErr error
+	var err = ep.updateByID(id, func(c *Conn) {
+		ctlErr = unix.EpollCtl(ep.connEpfd(c), unix.EPOLL_CTL_MOD, c.Fd, &unix.EpollEvent{
+			Events: EPOLL_EVENTS_EPOLLIN,
+			Fd:     int32(c.Fd),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return ctlErr
+}
+
+// like WriteSSL, the SSL object cannot be freed meanwhile since it is written under the map lock
+func (ep *EP) WriteSSLByID(id ConnID, msg []byte, n int) (int, int, error) {
+	var writed, errno = -1, -1
+	var err = ep.updateByID(id, func(c *Conn) {
+		c.sslLock.Lock()
+		defer c.sslLock.Unlock()
+		if c.SSL != nil {
+			writed, errno = sslWrite(c.SSL.SSL, msg, n)
+			ep.countWrite(writed)
+		}
+	})
+	return writed, errno, err
+}
+
+// the fd is removed from epoll under the map lock, so it cannot be closed and reused in between
+func (ep *EP) DestroyConnectionByID(id ConnID) error {
+	var sequenceId int
+	var delErr error
+	var err = ep.updateByID(id, func(c *Conn) {
+		sequenceId = c.SequenceId
+		delErr = unix.EpollCtl(ep.connEpfd(c), unix.EPOLL_CTL_DEL, c.Fd, nil)
+	})
+	if err != nil {
+		return err
+	}
+	if delErr != nil {
+		return delErr
+	}
+	ep.countClose(CLOSE_REASON_APP)
+	ep.InvokeClose(sequenceId, id.Fd())
+	return nil
+}
+
+func (ep *EP) SendByID(id ConnID, msg []byte) error {
+	var conn, err = ep.GetConnectionByID(id)
+	if err != nil {
+		return err
+	}
+	return ep.send(conn, id, msg)
+}
+
+func (ep *EP) SendMessageByID(id ConnID, msg []byte) error {
+	if ep.Codec == nil {
+		return ep.SendByID(id, msg)
+	}
+	var frame, err = ep.Codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	return ep.SendByID(id, frame)
+}
+
+// raw write like Write, done under the map lock so the fd cannot be closed meanwhile,
+// TLS connections return ErrorWriteTLS unless the kernel encrypts the records (kTLS)
+func (ep *EP) WriteByID(id ConnID, msg []byte) (int, error) {
+	var n int
+	var writeErr error
+	var err = ep.updateByID(id, func(c *Conn) {
+		c.outLock.Lock()
+		defer c.outLock.Unlock()
+		if c.SSL != nil && !c.ktlsSend {
+			writeErr = ErrorWriteTLS
+			return
+		}
+		n, writeErr = unix.Write(c.Fd, msg)
+		ep.countWrite(n)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, writeErr
+}
+
+// the epoll fd of the reactor owning the connection, without touching the connection map
+func (ep *EP) connEpfd(c *Conn) int {
+	if c.reactor != nil {
+		return c.reactor.epfd
+	}
+	return ep.Epfd
+}
@@ -0,0 +1,229 @@
+package epoll
+
+import (
+	"crypto/tls"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestConnID(t *testing.T) {
+	var tests = []struct {
+		fd         int
+		generation uint32
+	}{
+		{0, 1},
+		{3, 1},
+		{1 << 20, 7},
+		{math.MaxInt32, math.MaxUint32},
+		{-1, 2},
+	}
+	for _, tt := range tests {
+		var id = newConnID(tt.fd, tt.generation)
+		if id.Fd() != tt.fd || id.Generation() != tt.generation {
+			t.Errorf("newConnID(%d, %d) = fd %d generation %d", tt.fd, tt.generation, id.Fd(), id.Generation())
+		}
+	}
+}
+
+func TestNextGeneration(t *testing.T) {
+	var ep = newTestEP(t)
+	ep.generation = math.MaxUint32 - 1
+	var want uint32
+	for _, want = range []uint32{math.MaxUint32, 1, 2} {
+		if g := ep.nextGeneration(); g != want {
+			t.Fatalf("generation %d, want %d", g, want)
+		}
+	}
+}
+
+// a handle kept after its connection closed is rejected, also once the fd is reused
+func TestConnIDStale(t *testing.T) {
+	var ep = newTestEP(t)
+	var accepted = make(chan ConnID, 2)
+	var closed = make(chan ConnID, 2)
+	ep.OnAcceptID = func(id ConnID) { accepted <- id }
+	ep.OnCloseID = func(id ConnID) { closed <- id }
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListener("127.0.0.1", 0, nil)
+	})
+
+	var old = acceptID(t, accepted, addr, nil)
+	if err := ep.SetConnectionDataByID(old, "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ep.DestroyConnectionByID(old); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case id := <-closed:
+		if id != old {
+			t.Fatalf("closed %x, want %x", id, old)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for OnClose")
+	}
+
+	var c net.Conn
+	var id = acceptID(t, accepted, addr, &c)
+	defer c.Close()
+	if id.Fd() == old.Fd() && id.Generation() == old.Generation() {
+		t.Fatalf("handle %x reused", id)
+	}
+	if _, err := ep.GetConnectionDataByID(old); err != ErrorConnIDStale {
+		t.Fatalf("GetConnectionDataByID of a closed connection: %v", err)
+	}
+	if err := ep.SendByID(old, []byte("x")); err != ErrorConnIDStale {
+		t.Fatalf("SendByID of a closed connection: %v", err)
+	}
+	if err := ep.DestroyConnectionByID(old); err != ErrorConnIDStale {
+		t.Fatalf("DestroyConnectionByID of a closed connection: %v", err)
+	}
+	if _, err := ep.GetConnectionByID(0); err != ErrorConnIDStale {
+		t.Fatalf("GetConnectionByID of the zero handle: %v", err)
+	}
+
+	if data, err := ep.GetConnectionDataByID(id); err != nil || data != nil {
+		t.Fatalf("data of the new connection %v %v", data, err)
+	}
+	if err := ep.SendByID(id, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	var buf = make([]byte, 1)
+	if _, err := c.Read(buf); err != nil || buf[0] != 'x' {
+		t.Fatalf("read %q %v", buf, err)
+	}
+}
+
+// every ByID accessor rejects a stale handle and answers for a current one
+func TestConnIDAccessors(t *testing.T) {
+	var ep = newTestEP(t)
+	var accepted = make(chan ConnID, 1)
+	ep.OnAcceptID = func(id ConnID) { accepted <- id }
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListener("127.0.0.1", 0, nil)
+	})
+	var id = acceptID(t, accepted, addr, nil)
+	var stale = newConnID(id.Fd(), id.Generation()+1)
+
+	var tests = []struct {
+		name string
+		call func(id ConnID) error
+	}{
+		{"GetConnectionFamilyByID", func(id ConnID) error {
+			var family, err = ep.GetConnectionFamilyByID(id)
+			if err == nil && family != unix.AF_INET {
+				t.Errorf("family %d", family)
+			}
+			return err
+		}},
+		{"GetConnectionListenerByID", func(id ConnID) error {
+			var l, err = ep.GetConnectionListenerByID(id)
+			if err == nil && l == nil {
+				t.Errorf("no listener")
+			}
+			return err
+		}},
+		{"GetConnectionPeerCredByID", func(id ConnID) error {
+			var _, err = ep.GetConnectionPeerCredByID(id)
+			return err
+		}},
+		{"GetConnectionProxyTLVsByID", func(id ConnID) error {
+			var _, err = ep.GetConnectionProxyTLVsByID(id)
+			return err
+		}},
+		{"GetConnectionServerNameByID", func(id ConnID) error {
+			var _, err = ep.GetConnectionServerNameByID(id)
+			return err
+		}},
+		{"GetConnectionProtocolByID", func(id ConnID) error {
+			var _, err = ep.GetConnectionProtocolByID(id)
+			return err
+		}},
+		{"GetConnectionPeerCertificatesByID", func(id ConnID) error {
+			var _, err = ep.GetConnectionPeerCertificatesByID(id)
+			return err
+		}},
+		{"GetConnectionKTLSByID", func(id ConnID) error {
+			var _, _, err = ep.GetConnectionKTLSByID(id)
+			return err
+		}},
+		{"GetSendQueueLengthByID", func(id ConnID) error {
+			var length, err = ep.GetSendQueueLengthByID(id)
+			if err == nil && length != 0 {
+				t.Errorf("send queue length %d", length)
+			}
+			return err
+		}},
+		{"EnableEpollOutByID", ep.EnableEpollOutByID},
+		{"DisableEpollOutByID", ep.DisableEpollOutByID},
+		{"WriteSSLByID", func(id ConnID) error {
+			var _, _, err = ep.WriteSSLByID(id, []byte("x"), 1)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		if err := tt.call(stale); err != ErrorConnIDStale {
+			t.Errorf("%s of a stale handle: %v", tt.name, err)
+		}
+		if err := tt.call(id); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+// user space TLS records are written by the event loop only, a raw write would corrupt the stream
+func TestWriteByIDSSL(t *testing.T) {
+	var p = newTestPKI(t)
+	var certFile, keyFile, _ = p.issue(t, "server", []string{"localhost"}, false)
+
+	var ep = newEchoEP(t)
+	var accepted = make(chan ConnID, 1)
+	ep.OnAcceptID = func(id ConnID) { accepted <- id }
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListenerSSL("127.0.0.1", 0, certFile, keyFile, nil)
+	})
+
+	var c, err = dialTLS(t, addr, &tls.Config{ServerName: "localhost", RootCAs: p.pool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var id ConnID
+	select {
+	case id = <-accepted:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for OnAccept")
+	}
+	if ktls, _, _ := ep.GetConnectionKTLSByID(id); ktls {
+		t.Skip("the kernel encrypts the records")
+	}
+	if _, err = ep.WriteByID(id, []byte("x")); err != ErrorWriteTLS {
+		t.Fatalf("WriteByID on a TLS connection: %v", err)
+	}
+	echo(t, c, "still intact")
+}
+
+// connects to addr and returns the handle OnAcceptID reported, c receives the client side if set
+func acceptID(t *testing.T, accepted <-chan ConnID, addr string, c *net.Conn) ConnID {
+	var conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	if c != nil {
+		*c = conn
+	} else {
+		t.Cleanup(func() { conn.Close() })
+	}
+	select {
+	case id := <-accepted:
+		return id
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for OnAccept")
+	}
+	return 0
+}
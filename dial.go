@@ -0,0 +1,145 @@
+package epoll
+
+import (
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type dialing struct {
+	fd         int
+	generation uint32 // reserved for the Conn, so the handle returned by Dial stays valid once connected
+	timer      *time.Timer
+}
+
+// non-blocking connect, the result is reported by OnConnect or OnError with ERROR_CONNECT,
+// both carry the returned handle
+// network: tcp, tcp4, tcp6, unix, unixpacket, tcp addresses take an IP literal, host names are not resolved
+func (ep *EP) Dial(network string, address string, timeout time.Duration) (ConnID, error) {
+	var family, sockType, sa, err = resolveNetworkSockaddr(network, address)
+	if err != nil {
+		return 0, err
+	}
+
+	var fd int
+	if fd, err = unix.Socket(family, unix.O_NONBLOCK|sockType, 0); err != nil {
+		return 0, err
+	}
+
+	if family != unix.AF_UNIX {
+		unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1)
+	}
+
+	if err = unix.Connect(fd, sa); err != nil && err != unix.EINPROGRESS {
+		unix.Close(fd)
+		return 0, err
+	}
+
+	var d = &dialing{fd: fd, generation: ep.nextGeneration()}
+	ep.dials.Put(fd, d)
+	atomic.AddInt32(&ep.dialCount, 1)
+
+	if timeout > 0 {
+		// under the map lock, the event loop may already be looking at d
+		ep.dials.UpdateWithFunc(fd, func(value interface{}) {
+			d.timer = time.AfterFunc(timeout, func() {
+				if ep.removeDialing(fd) != nil {
+					ep.Delete(fd)
+					ep.CloseFd(fd)
+					ep.reportDialError(d, ErrorDialTimeout)
+				}
+			})
+		})
+	}
+
+	var event = &unix.EpollEvent{
+		Events: unix.EPOLLOUT | unix.EPOLLET,
+		Fd:     int32(fd),
+	}
+	if err = unix.EpollCtl(ep.Epfd, unix.EPOLL_CTL_ADD, fd, event); err != nil {
+		if ep.removeDialing(fd) != nil {
+			unix.Close(fd)
+		}
+		return 0, err
+	}
+
+	return newConnID(fd, d.generation), nil
+}
+
+func (ep *EP) isDialing(fd int) bool {
+	return atomic.LoadInt32(&ep.dialCount) > 0 && ep.dials.Exists(fd)
+}
+
+func (ep *EP) removeDialing(fd int) *dialing {
+	var d *dialing
+	var timer *time.Timer
+	ep.dials.RemoveAndUpdate(fd, func(value interface{}) {
+		if d, _ = value.(*dialing); d != nil {
+			timer = d.timer
+		}
+	})
+	if d != nil {
+		atomic.AddInt32(&ep.dialCount, -1)
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return d
+}
+
+func (ep *EP) connect(fd int) {
+	var d = ep.removeDialing(fd)
+	if d == nil {
+		return
+	}
+	ep.Delete(fd)
+
+	var errno, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err == nil && errno != 0 {
+		err = unix.Errno(errno)
+	}
+	if err != nil {
+		ep.CloseFd(fd)
+		ep.reportDialError(d, err)
+		return
+	}
+
+	var sequenceId int
+	if sequenceId, err = ep.establishConnection(fd, d.generation); err != nil {
+		ep.CloseFd(fd)
+		ep.reportDialError(d, err)
+		return
+	}
+
+	if ep.Callbacks.hasConnect() {
+		ep.InvokeConnect(sequenceId, fd)
+	}
+}
+
+// the fd is no longer in the connection map, the handle comes from the dial
+func (ep *EP) reportDialError(d *dialing, err error) {
+	ep.countError(ERROR_CONNECT)
+	if ep.Callbacks.hasError() {
+		var req = ep.getRequestItemForError(nil, d.fd, ERROR_CONNECT, err)
+		req.ConnID = newConnID(d.fd, d.generation)
+		ep.invoke(-1, req)
+	}
+}
+
+func (ep *EP) closeDials() {
+	var fd int
+	var ok bool
+	var fds = make([]int, 0)
+	ep.dials.Iterate(func(key interface{}, value interface{}) {
+		if fd, ok = key.(int); ok {
+			fds = append(fds, fd)
+		}
+	})
+	for _, fd = range fds {
+		if ep.removeDialing(fd) != nil {
+			ep.Delete(fd)
+			ep.CloseFd(fd)
+		}
+	}
+}
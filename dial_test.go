@@ -0,0 +1,128 @@
+package epoll
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestResolveNetworkSockaddr(t *testing.T) {
+	var tests = []struct {
+		network string
+		address string
+		family  int
+		ok      bool
+	}{
+		{"tcp", "127.0.0.1:80", unix.AF_INET, true},
+		{"tcp4", "127.0.0.1:80", unix.AF_INET, true},
+		{"tcp6", "127.0.0.1:80", unix.AF_INET6, true},
+		{"tcp", "[::1]:80", unix.AF_INET6, true},
+		{"tcp6", "[::1]:80", unix.AF_INET6, true},
+		{"tcp4", "[::1]:80", 0, false},
+		{"tcp", "localhost:80", 0, false},
+		{"tcp", "127.0.0.1:http", 0, false},
+		{"tcp", "127.0.0.1:65536", 0, false},
+		{"tcp", "127.0.0.1", 0, false},
+		{"unix", "/tmp/x.sock", unix.AF_UNIX, true},
+		{"unixpacket", "/tmp/x.sock", unix.AF_UNIX, true},
+		{"udp", "127.0.0.1:80", 0, false},
+	}
+	for _, tt := range tests {
+		var family, _, _, err = resolveNetworkSockaddr(tt.network, tt.address)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s %s: error %v, want ok %v", tt.network, tt.address, err, tt.ok)
+			continue
+		}
+		if tt.ok && family != tt.family {
+			t.Errorf("%s %s: family %d, want %d", tt.network, tt.address, family, tt.family)
+		}
+	}
+}
+
+func TestDial(t *testing.T) {
+	var ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var ep = newTestEP(t)
+	var connected = make(chan ConnID, 1)
+	var received = make(chan string, 1)
+	ep.OnConnectID = func(id ConnID) { connected <- id }
+	ep.OnReceive = func(fd int, msg []byte, n int) {
+		received <- string(msg[:n])
+		ep.Send(fd, []byte("pong"))
+	}
+	serveTest(t, ep, nil)
+
+	var dialed ConnID
+	if dialed, err = ep.Dial("tcp", ln.Addr().String(), testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	var peer net.Conn
+	if peer, err = ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	select {
+	case id := <-connected:
+		if id != dialed {
+			t.Fatalf("OnConnect handle %x, Dial returned %x", id, dialed)
+		}
+		var addr, err = ep.RemoteAddrByID(id)
+		if err != nil || addr.String() != ln.Addr().String() {
+			t.Fatalf("remote address %v %v, want %s", addr, err, ln.Addr())
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for OnConnect")
+	}
+
+	peer.Write([]byte("ping"))
+	if s := receive(t, "OnReceive", received); s != "ping" {
+		t.Fatalf("received %q", s)
+	}
+	var buf = make([]byte, 4)
+	peer.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, err = io.ReadFull(peer, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("peer read %q %v", buf, err)
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	// a port nothing listens on
+	var ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addr = ln.Addr().String()
+	ln.Close()
+
+	var ep = newTestEP(t)
+	var failed = make(chan ConnID, 1)
+	ep.OnConnect = func(fd int) { t.Errorf("OnConnect for a refused connection") }
+	ep.OnErrorID = func(id ConnID, code ErrorCode, err error) {
+		if code != ERROR_CONNECT {
+			t.Errorf("error code %d, want ERROR_CONNECT", code)
+		}
+		failed <- id
+	}
+	serveTest(t, ep, nil)
+
+	var dialed ConnID
+	if dialed, err = ep.Dial("tcp", addr, testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case id := <-failed:
+		if id != dialed {
+			t.Fatalf("OnError handle %x, Dial returned %x", id, dialed)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for OnError")
+	}
+}
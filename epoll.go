@@ -1,7 +1,9 @@
 package epoll
 
 import (
+	"context"
 	"net"
+	"strconv"
 
 	"golang.org/x/sys/unix"
 
@@ -22,27 +24,28 @@ func New(readBuffer int, threads int, queueLength int) (*EP, error) {
 		return nil, err
 	}
 	var ep = &EP{
-		Epfd:         epfd,
-		Fd:           -9,
-		Connections:  hashmap.New(threads * DEFAULT_POOL_MULTIPLE),
-		SSLCtx:       nil,
-		IsSSL:        false,
-		ReadBuffer:   readBuffer,
-		WriteBuffer:  readBuffer,
-		WaitTimeout:  -1,
-		ReadTimeout:  DEFAULT_EPOLL_READ_TIMEOUT,
-		WriteTimeout: DEFAULT_EPOLL_WRITE_TIMEOUT,
-		Threads:      threads,
-		QueueLength:  queueLength,
-		KeepAlive:    0,
-		ReuseAddr:    1,
-		ReusePort:    1,
-		EpollEvents:  DEFAULT_EPOLL_EVENTS,
-		OnAccept:     nil,
-		OnReceive:    nil,
-		OnEpollOut:   nil,
-		OnClose:      nil,
-		OnError:      nil,
+		Epfd:             epfd,
+		Fd:               -9,
+		Connections:      hashmap.New(threads * DEFAULT_POOL_MULTIPLE),
+		dials:            hashmap.New(threads),
+		ipCounts:         make(map[[16]byte]int),
+		SSLCtx:           nil,
+		IsSSL:            false,
+		ReadBuffer:       readBuffer,
+		WriteBuffer:      readBuffer,
+		WaitTimeout:      -1,
+		ReadTimeout:      DEFAULT_EPOLL_READ_TIMEOUT,
+		WriteTimeout:     DEFAULT_EPOLL_WRITE_TIMEOUT,
+		Threads:          threads,
+		QueueLength:      queueLength,
+		KeepAlive:        0,
+		ReuseAddr:        1,
+		ReusePort:        1,
+		V6Only:           0,
+		HandshakeTimeout: DEFAULT_SSL_HANDSHAKE_TIMEOUT,
+		IdleTimeout:      0,
+		MaxFrameSize:     DEFAULT_MAX_FRAME_SIZE,
+		EpollEvents:      DEFAULT_EPOLL_EVENTS,
 	}
 
 	ep.bufferPool = ep.newBufferPool(readBuffer, threads*DEFAULT_POOL_MULTIPLE)
@@ -57,13 +60,24 @@ func New(readBuffer int, threads int, queueLength int) (*EP, error) {
 	ep.connPool.EnableRecycle()
 	ep.requestPool.EnableRecycle()
 
+	var r *reactor
+	if r, err = ep.newReactor(0, epfd); err != nil {
+		unix.Close(epfd)
+		return nil, err
+	}
+	ep.reactors = []*reactor{r}
+
 	ep.threadPoolSequence = ep.newThreadPoolSequence()
+	ep.listeners.Store([]*Listener{})
+	ep.listenerFds.Store(map[int]*Listener{})
+	ep.done = make(chan struct{})
 
 	return ep, nil
 }
 
 func (ep *EP) newBufferPool(length int, capacity int) *pool.Pool {
 	return pool.New(length, func() interface{} {
+		ep.metrics.bufferPool.alloc()
 		var b = make([]byte, length)
 		return &b
 	})
@@ -71,12 +85,14 @@ func (ep *EP) newBufferPool(length int, capacity int) *pool.Pool {
 
 func (ep *EP) newConnPool(capacity int) *pool.Pool {
 	return pool.NewWithId(capacity, func(id uint64) interface{} {
+		ep.metrics.connPool.alloc()
 		return &Conn{Id: id}
 	})
 }
 
 func (ep *EP) newRequestPool(capacity int) *pool.Pool {
 	return pool.NewWithId(capacity, func(id uint64) interface{} {
+		ep.metrics.requestPool.alloc()
 		return &Request{Id: id}
 	})
 }
@@ -97,6 +113,13 @@ func (ep *EP) SetWriteBuffer(n int) {
 	ep.WriteBuffer = n
 }
 
+// Send rejects data beyond high bytes queued, 0 means unlimited
+// OnDrain fires once the queue falls to low bytes or less
+func (ep *EP) SetWriteWatermark(low int, high int) {
+	ep.LowWatermark = low
+	ep.HighWatermark = high
+}
+
 func (ep *EP) SetKeepAlive(n int) {
 	ep.KeepAlive = n
 }
@@ -105,121 +128,214 @@ func (ep *EP) SetReuseAddr(n int) {
 	ep.ReuseAddr = n
 }
 
+// TCP listeners always set SO_REUSEPORT in REACTOR_MODE_REUSEPORT
 func (ep *EP) SetReusePort(n int) {
 	ep.ReusePort = n
 }
 
+// seconds allowed for the SSL handshake of a new connection, and for the PROXY protocol header
+// on listeners that expect one, 0 disables the limit
+func (ep *EP) SetHandshakeTimeout(n int) {
+	ep.HandshakeTimeout = n
+}
+
+// 0 accepts both IPv4 and IPv6 on an IPv6 listener, 1 accepts IPv6 only
+func (ep *EP) SetV6Only(n int) {
+	ep.V6Only = n
+}
+
 func (ep *EP) SetEpollEvents(n int) {
 	ep.EpollEvents = n
 }
 
-// pure EPOLL
-func (ep *EP) Start(host string, port int) {
+// pure EPOLL, blocks until the EP is stopped
+// bind and listen errors are returned as *StartError, and the EP can be started again after a failure
+func (ep *EP) Start(host string, port int) error {
 	ep.Host = host
 	ep.Port = port
 	var err error
 	if err = ep.InitEpoll(ep.Host, ep.Port); err != nil {
-		panic(err)
+		return err
 	}
 	ep.listen()
+	return nil
+}
+
+// certificate and key errors are returned as *StartError with Op "ssl", see ErrorSSLCertificate
+func (ep *EP) StartSSL(host string, port int, certFile string, keyFile string) error {
+	return ep.StartSSLCertificates(host, port, &SSLCertificates{Default: SSLCertificate{CertFile: certFile, KeyFile: keyFile}})
 }
 
-func (ep *EP) StartSSL(host string, port int, certFile string, keyFile string) {
+// like StartSSL, with a certificate per server name, see SSLCertificates
+func (ep *EP) StartSSLCertificates(host string, port int, certs *SSLCertificates) error {
+	var opts = ep.sslOptions
+	var ctx, err = newSNISSLCtx(certs, opts)
+	if err != nil {
+		return newStartError("ssl", joinHostPort(host, port), err)
+	}
 	ep.IsSSL = true
 	ep.Host = host
 	ep.Port = port
-	var err error
+	ep.SSLCtx = ctx
+	ep.setSSLContext(newSSLContext(ctx, certs, opts))
+	ep.sslPool = ep.newSSLPool(ep.sslContext, ep.Threads*DEFAULT_POOL_MULTIPLE)
 	if err = ep.InitEpoll(ep.Host, ep.Port); err != nil {
-		panic(err)
+		freeSSLCtx(ctx)
+		ep.IsSSL = false
+		ep.SSLCtx = nil
+		ep.setSSLContext(nil)
+		closeSSLPool(ep.sslPool)
+		ep.sslPool = nil
+		return err
 	}
-	ep.SSLCtx = newSSLCtx(certFile, keyFile)
-	ep.sslPool = ep.newSSLPool(ep.Threads * DEFAULT_POOL_MULTIPLE)
-
-	ep.sslPool.RecycleUpdateFunc = sslRecycleUpdate
-	ep.sslPool.EnableRecycle()
-
-	ep.bufferPool.EnableQueue()
-	ep.connPool.EnableQueue()
-	ep.requestPool.EnableQueue()
-	ep.sslPool.EnableQueue()
-
-	cMallocTrimLoop()
+	ep.enableSSL(ep.sslPool)
 	ep.listen()
+	return nil
 }
 
-// pure EPOLL, only listening, needs to use ep.Add(fd)
+// pure EPOLL, only listening, needs to use ep.Add(fd) or ep.AddListener
 func (ep *EP) Listen() {
 	ep.listen()
 }
 
+// like Listen, and stops the EP once ctx is done, the listeners are added beforehand with InitEpoll or AddListener
+// returns once the EP has been stopped and cleaned up,
+// with ctx.Err() if ctx stopped the EP, nil if Stop or Shutdown did
+func (ep *EP) Run(ctx context.Context) error {
+	var exited = make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			ep.Stop()
+		case <-exited:
+		}
+	}()
+	ep.listen()
+	close(exited)
+	if ep.isStopped() || ctx.Err() != nil {
+		// the loops return as soon as Stop begins, the Stop running elsewhere holds this one until it is done
+		ep.Stop()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		return nil
+	}
+}
+
 func (ep *EP) InitEpoll(host string, port int) error {
+	var n, fd = len(ep.getListeners()), ep.getListenFd()
+	var l, err = ep.newTCPListener(host, port)
+	if err != nil {
+		return newStartError("listen", joinHostPort(host, port), err)
+	}
+	l.IsSSL = ep.IsSSL
+	l.SSLCtx = ep.SSLCtx
+	l.sslContext = ep.sslContext
+	l.sslPool = ep.sslPool
+	ep.setListenFd(l.Fd)
+	ep.Family = l.Family
+	if err = ep.addListeners(l); err != nil {
+		ep.removeListenersFrom(n)
+		ep.setListenFd(fd)
+		return newStartError("listen", joinHostPort(host, port), err)
+	}
+	return nil
+}
+
+func (ep *EP) newTCPListener(host string, port int) (*Listener, error) {
 	var err error
+	var fd, family int
+	var addr unix.Sockaddr
 
-	if ep.Fd, err = unix.Socket(unix.AF_INET, unix.O_NONBLOCK|unix.SOCK_STREAM, 0); err != nil {
-		return err
+	if family, addr, err = resolveSockaddr(host, port); err != nil {
+		return nil, err
 	}
 
-	if err = unix.SetNonblock(ep.Fd, true); err != nil {
-		unix.Close(ep.Fd)
-		return err
+	if fd, err = unix.Socket(family, unix.O_NONBLOCK|unix.SOCK_STREAM, 0); err != nil {
+		return nil, err
 	}
 
-	if err = unix.SetsockoptInt(ep.Fd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1); err != nil {
-		unix.Close(ep.Fd)
-		return err
+	if err = unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
 	}
 
-	if err = unix.SetsockoptInt(ep.Fd, unix.IPPROTO_TCP, unix.TCP_QUICKACK, 1); err != nil {
-		unix.Close(ep.Fd)
-		return err
+	if err = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1); err != nil {
+		unix.Close(fd)
+		return nil, err
 	}
 
-	if err = unix.SetsockoptInt(ep.Fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, ep.ReuseAddr); err != nil {
-		unix.Close(ep.Fd)
-		return err
+	if err = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_QUICKACK, 1); err != nil {
+		unix.Close(fd)
+		return nil, err
 	}
 
-	if err = unix.SetsockoptInt(ep.Fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, ep.ReusePort); err != nil {
-		unix.Close(ep.Fd)
-		return err
+	if err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, ep.ReuseAddr); err != nil {
+		unix.Close(fd)
+		return nil, err
 	}
 
-	var addr = unix.SockaddrInet4{Port: port}
-	copy(addr.Addr[:], net.ParseIP(host).To4())
+	// the copies for the other loops share the port, see addReusePortListeners
+	var reusePort = ep.ReusePort
+	if ep.ReactorMode == REACTOR_MODE_REUSEPORT {
+		reusePort = 1
+	}
+	if err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, reusePort); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
 
-	if err = unix.Bind(ep.Fd, &addr); err != nil {
-		unix.Close(ep.Fd)
-		return err
+	if family == unix.AF_INET6 {
+		if err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, ep.V6Only); err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
 	}
-	if err = unix.Listen(ep.Fd, unix.SOMAXCONN); err != nil {
-		unix.Close(ep.Fd)
-		return err
+
+	if err = bindListener(fd, addr); err != nil {
+		return nil, err
 	}
 
-	var event unix.EpollEvent
-	event.Events = unix.EPOLLIN | unix.EPOLLOUT | unix.EPOLLET
-	event.Fd = int32(ep.Fd)
+	return &Listener{Fd: fd, Host: host, Port: port, Family: family, ProxyProtocol: ep.ProxyProtocol}, nil
+}
+
+func bindListener(fd int, addr unix.Sockaddr) error {
+	var err error
 
-	if err = unix.EpollCtl(ep.Epfd, unix.EPOLL_CTL_ADD, ep.Fd, &event); err != nil {
+	if err = unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	if err = unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
 		return err
 	}
 
 	return nil
 }
 
+func joinHostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
 func (ep *EP) Stop() error {
-	ep.CloseAll()
-	if ep.Fd >= 0 {
-		if ep.Delete(ep.Fd) == nil {
-			ep.Close(ep.Fd)
-		}
-	}
-	if ep.Epfd >= 0 {
-		unix.Close(ep.Epfd)
-	}
-	if ep.SSLCtx != nil {
-		ep.freeSSLCtx()
-	}
-	ep.threadPoolSequence.Close()
+	ep.stopOnce.Do(ep.stop)
 	return nil
 }
+
+func (ep *EP) stop() {
+	ep.stopLock.Lock()
+	close(ep.done)
+	ep.stopLock.Unlock()
+	ep.wakeReactors()
+	ep.loops.Wait()
+	ep.closeDials()
+	ep.CloseAll()
+	ep.closeListeners()
+	ep.closeReactors()
+	ep.freeSSLCtxs()
+	ep.releaseTickets()
+	ep.stopThreadPool()
+}
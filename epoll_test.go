@@ -0,0 +1,77 @@
+package epoll
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	testTimeout = 5 * time.Second
+)
+
+// the buffers are also the socket buffers, smaller ones stall loopback TCP with its 64KB segments
+func newTestEP(t *testing.T) *EP {
+	var ep, err = New(64<<10, 4, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ep
+}
+
+// runs the loops of ep with the listener added by add, if any, and shuts ep down at the end of the test,
+// returns the address the listener is bound to
+func serveTest(t *testing.T, ep *EP, add func() (*Listener, error)) string {
+	var addr string
+	if add != nil {
+		var l, err = add()
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = listenerAddr(t, l)
+	}
+	var done = make(chan struct{})
+	go func() {
+		ep.Listen()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		var ctx, cancel = context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		if err := ep.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+		<-done
+	})
+	return addr
+}
+
+func listenerAddr(t *testing.T, l *Listener) string {
+	var sa, err = unix.Getsockname(l.Fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sockaddrToAddr(sa).String()
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	var deadline = time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func receive(t *testing.T, what string, ch <-chan string) string {
+	select {
+	case s := <-ch:
+		return s
+	case <-time.After(testTimeout):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+	return ""
+}
@@ -2,24 +2,75 @@ package epoll
 
 import (
 	"errors"
+	"fmt"
 )
 
 var (
-	ErrorTemplateNotFound = "%d not found in the list"
+	ErrorTemplateNotFound       = "%d not found in the list"
+	ErrorTemplateInvalidHost    = "%s is not a valid IP address"
+	ErrorTemplateInvalidPort    = "%s is not a valid port number"
+	ErrorTemplateUnknownNetwork = "unknown network %s"
+	ErrorTemplateLengthSize     = "invalid length field size %d"
+	ErrorTemplateFixedSize      = "invalid fixed frame size %d"
+	ErrorTemplateALPNProtocol   = "invalid ALPN protocol %q"
+	ErrorTemplateReactorCount   = "invalid reactor count %d, at least %d"
 )
 
 var (
-	ErrorGetPoolBuffer = errors.New("get pool buffer error")
+	ErrorGetPoolBuffer      = errors.New("get pool buffer error")
+	ErrorDialTimeout        = errors.New("dial timeout")
+	ErrorWriteQueueFull     = errors.New("write queue is full")
+	ErrorFrameTooLarge      = errors.New("frame is too large")
+	ErrorFrameSize          = errors.New("frame size does not match the codec")
+	ErrorCodecDelimiter     = errors.New("codec delimiter is empty")
+	ErrorConnIDStale        = errors.New("connection handle is stale")
+	ErrorProxyHeader        = errors.New("invalid PROXY protocol header")
+	ErrorProxyHeaderTimeout = errors.New("PROXY protocol header timeout")
+	ErrorMessageTruncated   = errors.New("message is larger than the read buffer")
+	ErrorSendFileShort      = errors.New("file ended before length bytes were sent")
+	ErrorSendFileAborted    = errors.New("connection closed before the file was sent")
+	ErrorWriteTLS           = errors.New("raw write on a TLS connection, use SendByID")
 )
 
 var (
-	ErrorSSLUnableCreate = errors.New("unable to create SSL connection")
-	ErrorSSLUnknow       = errors.New("ssl error unknow")
-	ErrorSSLWantWrite    = errors.New("ssl error want write")
-	ErrorSSLWantRead     = errors.New("ssl error want read")
-	ErrorSSLZeroReturn   = errors.New("ssl error zero return")
-	ErrorSSLWantConnect  = errors.New("ssl error want connect")
-	ErrorSSLTimeout      = errors.New("ssl error timeout")
-	ErrorSSL             = errors.New("ssl error")
-	ErrorSSLSyscall      = errors.New("ssl error syscall")
+	ErrorSSLUnableCreate     = errors.New("unable to create SSL connection")
+	ErrorSSLUnknow           = errors.New("ssl error unknow")
+	ErrorSSLWantWrite        = errors.New("ssl error want write")
+	ErrorSSLWantRead         = errors.New("ssl error want read")
+	ErrorSSLZeroReturn       = errors.New("ssl error zero return")
+	ErrorSSLWantConnect      = errors.New("ssl error want connect")
+	ErrorSSLTimeout          = errors.New("ssl error timeout")
+	ErrorSSL                 = errors.New("ssl error")
+	ErrorSSLSyscall          = errors.New("ssl error syscall")
+	ErrorSSLHandshakeTimeout = errors.New("ssl handshake timeout")
+	ErrorSSLInit             = errors.New("unable to init SSL")
+	ErrorSSLContext          = errors.New("unable to create SSL context")
+	ErrorSSLCertificate      = errors.New("unable to set certificate")
+	ErrorSSLPrivateKey       = errors.New("unable to set private key")
+	ErrorSSLCA               = errors.New("unable to load CA certificates")
+	ErrorSSLCRL              = errors.New("unable to load CRL")
+	ErrorSSLNoCA             = fmt.Errorf("%w: neither CAFile nor CAPath is set", ErrorSSLCA)
+	ErrorSSLNoCRL            = fmt.Errorf("%w: CRLCheckAll is set without CRLFile", ErrorSSLCRL)
+	ErrorSSLNotStarted       = errors.New("ssl is not started")
+	ErrorSSLConfig           = errors.New("invalid SSL configuration")
 )
+
+// returned when a listener cannot be started, Op is "listen" for socket, bind and listen errors
+// and "ssl" for certificate and key errors, Err is the cause, e.g. unix.EADDRINUSE or ErrorSSLCertificate
+type StartError struct {
+	Op   string
+	Addr string
+	Err  error
+}
+
+func newStartError(op string, addr string, err error) *StartError {
+	return &StartError{Op: op, Addr: addr, Err: err}
+}
+
+func (e *StartError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Op, e.Addr, e.Err.Error())
+}
+
+func (e *StartError) Unwrap() error {
+	return e.Err
+}
@@ -14,4 +14,10 @@ const (
 	ERROR_EPOLL_WAIT            ErrorCode = 8
 	ERROR_STOP                  ErrorCode = 9
 	ERROR_POOL_BUFFER           ErrorCode = 10
+	ERROR_CONNECT               ErrorCode = 11
+	ERROR_SSL_HANDSHAKE         ErrorCode = 12
+	ERROR_FRAME                 ErrorCode = 13
+	ERROR_PROXY_PROTOCOL        ErrorCode = 14
+	ERROR_SSL_RELOAD            ErrorCode = 15
+	ERROR_SSL_TICKET_KEY        ErrorCode = 16
 )
@@ -1,7 +1,148 @@
 package epoll
 
+import (
+	"net"
+	"os"
+)
+
+type OnAcceptFilterEvent func(addr net.Addr) bool
 type OnAcceptEvent func(fd int)
+type OnConnectEvent func(fd int)
 type OnCloseEvent func(fd int)
 type OnReceiveEvent func(fd int, msg []byte, n int)
+type OnMessageEvent func(fd int, msg []byte)
 type OnEpollOutEvent func(fd int)
+type OnDrainEvent func(fd int)
+type OnIdleEvent func(fd int)
+type OnSendFileEvent func(fd int, file *os.File, n int64, err error)
 type OnErrorEvent func(fd int, code ErrorCode, err error)
+
+// same events keyed by the connection handle, see ConnID
+type OnAcceptIDEvent func(id ConnID)
+type OnConnectIDEvent func(id ConnID)
+type OnCloseIDEvent func(id ConnID)
+type OnReceiveIDEvent func(id ConnID, msg []byte, n int)
+type OnMessageIDEvent func(id ConnID, msg []byte)
+type OnEpollOutIDEvent func(id ConnID)
+type OnDrainIDEvent func(id ConnID)
+type OnIdleIDEvent func(id ConnID)
+type OnSendFileIDEvent func(id ConnID, file *os.File, n int64, err error)
+type OnErrorIDEvent func(id ConnID, code ErrorCode, err error)
+
+// when both variants of an event are set, only the ID one is called
+type Callbacks struct {
+	OnAcceptFilter OnAcceptFilterEvent // called right after accept, false closes the connection before TLS setup
+
+	OnAccept   OnAcceptEvent
+	OnConnect  OnConnectEvent
+	OnReceive  OnReceiveEvent
+	OnMessage  OnMessageEvent // used with a Codec instead of OnReceive
+	OnEpollOut OnEpollOutEvent
+	OnDrain    OnDrainEvent
+	OnIdle     OnIdleEvent
+	OnSendFile OnSendFileEvent // n bytes of a SendFile were sent, err is nil once all of them were
+	OnClose    OnCloseEvent
+	OnError    OnErrorEvent
+
+	OnAcceptID   OnAcceptIDEvent
+	OnConnectID  OnConnectIDEvent
+	OnReceiveID  OnReceiveIDEvent
+	OnMessageID  OnMessageIDEvent
+	OnEpollOutID OnEpollOutIDEvent
+	OnDrainID    OnDrainIDEvent
+	OnIdleID     OnIdleIDEvent
+	OnSendFileID OnSendFileIDEvent
+	OnCloseID    OnCloseIDEvent
+	OnErrorID    OnErrorIDEvent
+}
+
+func (cb *Callbacks) hasAccept() bool   { return cb.OnAccept != nil || cb.OnAcceptID != nil }
+func (cb *Callbacks) hasConnect() bool  { return cb.OnConnect != nil || cb.OnConnectID != nil }
+func (cb *Callbacks) hasReceive() bool  { return cb.OnReceive != nil || cb.OnReceiveID != nil }
+func (cb *Callbacks) hasMessage() bool  { return cb.OnMessage != nil || cb.OnMessageID != nil }
+func (cb *Callbacks) hasEpollOut() bool { return cb.OnEpollOut != nil || cb.OnEpollOutID != nil }
+func (cb *Callbacks) hasDrain() bool    { return cb.OnDrain != nil || cb.OnDrainID != nil }
+func (cb *Callbacks) hasIdle() bool     { return cb.OnIdle != nil || cb.OnIdleID != nil }
+func (cb *Callbacks) hasSendFile() bool { return cb.OnSendFile != nil || cb.OnSendFileID != nil }
+func (cb *Callbacks) hasClose() bool    { return cb.OnClose != nil || cb.OnCloseID != nil }
+func (cb *Callbacks) hasError() bool    { return cb.OnError != nil || cb.OnErrorID != nil }
+
+func (cb *Callbacks) accept(id ConnID) {
+	if cb.OnAcceptID != nil {
+		cb.OnAcceptID(id)
+	} else if cb.OnAccept != nil {
+		cb.OnAccept(id.Fd())
+	}
+}
+
+func (cb *Callbacks) connect(id ConnID) {
+	if cb.OnConnectID != nil {
+		cb.OnConnectID(id)
+	} else if cb.OnConnect != nil {
+		cb.OnConnect(id.Fd())
+	}
+}
+
+func (cb *Callbacks) receive(id ConnID, msg []byte, n int) {
+	if cb.OnReceiveID != nil {
+		cb.OnReceiveID(id, msg, n)
+	} else if cb.OnReceive != nil {
+		cb.OnReceive(id.Fd(), msg, n)
+	}
+}
+
+func (cb *Callbacks) message(id ConnID, msg []byte) {
+	if cb.OnMessageID != nil {
+		cb.OnMessageID(id, msg)
+	} else if cb.OnMessage != nil {
+		cb.OnMessage(id.Fd(), msg)
+	}
+}
+
+func (cb *Callbacks) epollOut(id ConnID) {
+	if cb.OnEpollOutID != nil {
+		cb.OnEpollOutID(id)
+	} else if cb.OnEpollOut != nil {
+		cb.OnEpollOut(id.Fd())
+	}
+}
+
+func (cb *Callbacks) drain(id ConnID) {
+	if cb.OnDrainID != nil {
+		cb.OnDrainID(id)
+	} else if cb.OnDrain != nil {
+		cb.OnDrain(id.Fd())
+	}
+}
+
+func (cb *Callbacks) idle(id ConnID) {
+	if cb.OnIdleID != nil {
+		cb.OnIdleID(id)
+	} else if cb.OnIdle != nil {
+		cb.OnIdle(id.Fd())
+	}
+}
+
+func (cb *Callbacks) sendFile(id ConnID, file *os.File, n int64, err error) {
+	if cb.OnSendFileID != nil {
+		cb.OnSendFileID(id, file, n, err)
+	} else if cb.OnSendFile != nil {
+		cb.OnSendFile(id.Fd(), file, n, err)
+	}
+}
+
+func (cb *Callbacks) close(id ConnID) {
+	if cb.OnCloseID != nil {
+		cb.OnCloseID(id)
+	} else if cb.OnClose != nil {
+		cb.OnClose(id.Fd())
+	}
+}
+
+func (cb *Callbacks) error(id ConnID, code ErrorCode, err error) {
+	if cb.OnErrorID != nil {
+		cb.OnErrorID(id, code, err)
+	} else if cb.OnError != nil {
+		cb.OnError(id.Fd(), code, err)
+	}
+}
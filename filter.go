@@ -0,0 +1,138 @@
+package epoll
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// allow and deny hold CIDRs or single addresses, deny wins and an empty allow list admits every address not denied
+// the lists replace the previous ones atomically, so they can be swapped while the EP is running
+// behind a PROXY protocol listener the address checked is that of the proxy, see SetProxyProtocol
+func (ep *EP) SetIPFilter(allow []string, deny []string) error {
+	var f = &ipFilter{}
+	var err error
+	if f.allow, err = parseIPNets(allow); err != nil {
+		return err
+	}
+	if f.deny, err = parseIPNets(deny); err != nil {
+		return err
+	}
+	ep.ipFilter.Store(f)
+	return nil
+}
+
+// concurrent connections accepted from one source address, 0 means unlimited,
+// the source is the proxy for PROXY protocol listeners
+func (ep *EP) SetMaxConnectionsPerIP(n int) {
+	ep.MaxConnectionsPerIP = n
+}
+
+func parseIPNets(list []string) ([]*net.IPNet, error) {
+	var nets = make([]*net.IPNet, 0, len(list))
+	var s string
+	for _, s = range list {
+		if strings.Contains(s, "/") {
+			var _, n, err = net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, n)
+			continue
+		}
+		var ip = net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New(fmt.Sprintf(ErrorTemplateInvalidHost, s))
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			nets = append(nets, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+		} else {
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+		}
+	}
+	return nets, nil
+}
+
+func (f *ipFilter) allows(ip net.IP) bool {
+	var n *net.IPNet
+	for _, n = range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n = range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// runs right after unix.Accept, before any Conn or SSL object exists
+// a slot of the per IP limit is reserved when it returns true, see releaseIP
+func (ep *EP) admit(cb *Callbacks, sa unix.Sockaddr) (net.IP, bool) {
+	var ip = sockaddrIP(sa)
+	if ip != nil {
+		if f, _ := ep.ipFilter.Load().(*ipFilter); f != nil && !f.allows(ip) {
+			return nil, false
+		}
+	}
+	if cb.OnAcceptFilter != nil && !cb.OnAcceptFilter(sockaddrToAddr(sa)) {
+		return nil, false
+	}
+	if ip == nil || ep.MaxConnectionsPerIP <= 0 {
+		return nil, true
+	}
+	var key = ipKey(ip)
+	ep.ipLock.Lock()
+	defer ep.ipLock.Unlock()
+	if ep.ipCounts[key] >= ep.MaxConnectionsPerIP {
+		return nil, false
+	}
+	ep.ipCounts[key]++
+	return ip, true
+}
+
+func (ep *EP) releaseIP(ip net.IP) {
+	if ip == nil {
+		return
+	}
+	var key = ipKey(ip)
+	ep.ipLock.Lock()
+	if ep.ipCounts[key] <= 1 {
+		delete(ep.ipCounts, key)
+	} else {
+		ep.ipCounts[key]--
+	}
+	ep.ipLock.Unlock()
+}
+
+// connections currently counted against the per IP limit for ip
+func (ep *EP) GetConnectionCountByIP(ip net.IP) int {
+	ep.ipLock.Lock()
+	defer ep.ipLock.Unlock()
+	return ep.ipCounts[ipKey(ip)]
+}
+
+func (ep *EP) rejectAccept(fd int) {
+	ep.CloseFd(fd)
+	atomic.AddUint64(&ep.metrics.acceptRejects, 1)
+}
+
+func ipKey(ip net.IP) [16]byte {
+	var key [16]byte
+	copy(key[:], ip.To16())
+	return key
+}
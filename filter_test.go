@@ -0,0 +1,140 @@
+package epoll
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIPFilterAllows(t *testing.T) {
+	var tests = []struct {
+		name  string
+		allow []string
+		deny  []string
+		ip    string
+		want  bool
+	}{
+		{"no lists", nil, nil, "192.0.2.1", true},
+		{"denied address", nil, []string{"192.0.2.1"}, "192.0.2.1", false},
+		{"other address", nil, []string{"192.0.2.1"}, "192.0.2.2", true},
+		{"allowed network", []string{"192.0.2.0/24"}, nil, "192.0.2.7", true},
+		{"outside the allowed network", []string{"192.0.2.0/24"}, nil, "198.51.100.1", false},
+		{"deny wins", []string{"192.0.2.0/24"}, []string{"192.0.2.7"}, "192.0.2.7", false},
+		{"IPv6", []string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+		{"IPv4-mapped", nil, []string{"192.0.2.1"}, "::ffff:192.0.2.1", false},
+	}
+	for _, tt := range tests {
+		var ep = newTestEP(t)
+		if err := ep.SetIPFilter(tt.allow, tt.deny); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var f = ep.ipFilter.Load().(*ipFilter)
+		if got := f.allows(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("%s: %s allowed %v, want %v", tt.name, tt.ip, got, tt.want)
+		}
+	}
+
+	var ep = newTestEP(t)
+	var invalid = []string{"localhost", "192.0.2.0/33", ""}
+	var s string
+	for _, s = range invalid {
+		if err := ep.SetIPFilter([]string{s}, nil); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
+
+// a denied peer is closed right after accept, swapping the lists takes effect for the next connection
+func TestIPFilter(t *testing.T) {
+	var ep = newEchoEP(t)
+	var accepted int32
+	ep.OnAccept = func(fd int) { atomic.AddInt32(&accepted, 1) }
+	if err := ep.SetIPFilter(nil, []string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListener("127.0.0.1", 0, nil)
+	})
+
+	expectRejected(t, addr)
+	if n := ep.Stats().AcceptRejects; n != 1 {
+		t.Fatalf("%d rejects, want 1", n)
+	}
+	if n := atomic.LoadInt32(&accepted); n != 0 {
+		t.Fatalf("OnAccept for a denied peer")
+	}
+
+	if err := ep.SetIPFilter([]string{"127.0.0.0/8"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(testTimeout))
+	echo(t, c, "allowed")
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Fatalf("%d OnAccept calls, want 1", n)
+	}
+}
+
+// the slot of a closed connection is free for the next one from the same address
+func TestMaxConnectionsPerIP(t *testing.T) {
+	var ep = newEchoEP(t)
+	ep.SetMaxConnectionsPerIP(1)
+	var closed = make(chan struct{}, 1)
+	ep.OnClose = func(fd int) { closed <- struct{}{} }
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListener("127.0.0.1", 0, nil)
+	})
+	var ip = net.ParseIP("127.0.0.1")
+
+	var c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(testTimeout))
+	echo(t, c, "first")
+	if n := ep.GetConnectionCountByIP(ip); n != 1 {
+		t.Fatalf("%d connections counted for %s, want 1", n, ip)
+	}
+
+	expectRejected(t, addr)
+	if n := ep.Stats().AcceptRejects; n != 1 {
+		t.Fatalf("%d rejects, want 1", n)
+	}
+
+	c.Close()
+	select {
+	case <-closed:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for OnClose")
+	}
+	if n := ep.GetConnectionCountByIP(ip); n != 0 {
+		t.Fatalf("%d connections counted for %s after the close", n, ip)
+	}
+	if c, err = net.Dial("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(testTimeout))
+	echo(t, c, "second")
+}
+
+// the connection is accepted by the kernel and closed by the EP without reading
+func expectRejected(t *testing.T, addr string) {
+	var c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(testTimeout))
+	c.Write([]byte("rejected"))
+	if _, err = c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read from a rejected connection")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("rejected connection still open")
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/gotcp/epoll
 
-go 1.15
+go 1.21
 
 require (
 	github.com/wuyongjia/hashmap v1.0.6
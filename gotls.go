@@ -0,0 +1,392 @@
+//go:build !cgo || gotls
+// +build !cgo gotls
+
+package epoll
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// the crypto/tls backend, used with the gotls build tag or when cgo is disabled
+type sslCtx struct {
+	config  *tls.Config
+	tickets *sessionTickets // rotates the ticket keys of config, nil without TicketKeyRotation
+}
+
+const (
+	tlsIdle    = 0
+	tlsRunning = 1 // the handshake goroutine has the handle
+	tlsParked  = 2 // the handshake goroutine waits for the fd to become readable
+	tlsDone    = 3
+	tlsFailed  = 4
+)
+
+// a TLS connection driven by the event loop over a non-blocking fd
+// crypto/tls cannot resume a handshake that stopped for lack of data, so the handshake runs on its own goroutine,
+// which parks when the fd has nothing to read and is resumed by sslAccept on the next readiness event
+type sslHandle struct {
+	ctx     *sslCtx
+	fd      int
+	conn    *tls.Conn
+	state   int
+	step    chan error // from the handshake goroutine, errWantRead once parked, otherwise the result
+	resume  chan bool  // to the parked handshake goroutine, false aborts it
+	errno   int        // of the last sslRead, see GetSSLErrorNumber
+	written int        // plaintext length of the records still in out, see sslWrite
+	out     []byte     // records not yet written to fd
+	outErr  error
+	outLock sync.Mutex
+}
+
+// returned by reads of an empty fd, crypto/tls keeps the records read so far and can be called again
+type wouldBlock struct{}
+
+func (wouldBlock) Error() string   { return "resource temporarily unavailable" }
+func (wouldBlock) Timeout() bool   { return true }
+func (wouldBlock) Temporary() bool { return true }
+
+var (
+	errWantRead = errors.New("ssl handshake wants read")
+	errAborted  = errors.New("ssl handshake aborted")
+)
+
+// the net.Conn crypto/tls runs on, reads go to the fd directly, writes are buffered in out
+type fdConn struct {
+	h *sslHandle
+}
+
+func (c fdConn) Read(b []byte) (int, error) {
+	var h = c.h
+	for {
+		if h.fd < 0 {
+			return 0, errAborted
+		}
+		var n, err = unix.Read(h.fd, b)
+		if n > 0 {
+			return n, nil
+		}
+		if err == nil {
+			return 0, io.EOF
+		}
+		if err == unix.EINTR {
+			continue
+		}
+		if err != unix.EAGAIN && err != unix.EWOULDBLOCK {
+			return 0, err
+		}
+		if h.state != tlsRunning {
+			return 0, wouldBlock{}
+		}
+		h.step <- errWantRead
+		if !<-h.resume {
+			return 0, errAborted
+		}
+	}
+}
+
+func (c fdConn) Write(b []byte) (int, error) {
+	var h = c.h
+	h.outLock.Lock()
+	defer h.outLock.Unlock()
+	if h.outErr != nil {
+		return 0, h.outErr
+	}
+	h.out = append(h.out, b...)
+	h.flushLocked()
+	if h.outErr != nil {
+		return 0, h.outErr
+	}
+	return len(b), nil
+}
+
+// the fd belongs to the EP
+func (c fdConn) Close() error                       { return nil }
+func (c fdConn) LocalAddr() net.Addr                { return nil }
+func (c fdConn) RemoteAddr() net.Addr               { return nil }
+func (c fdConn) SetDeadline(t time.Time) error      { return nil }
+func (c fdConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c fdConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// returns whether records are left in out
+func (h *sslHandle) flush() (bool, error) {
+	h.outLock.Lock()
+	defer h.outLock.Unlock()
+	h.flushLocked()
+	return len(h.out) > 0, h.outErr
+}
+
+func (h *sslHandle) flushLocked() {
+	for len(h.out) > 0 && h.fd >= 0 {
+		var n, err = unix.Write(h.fd, h.out)
+		if n > 0 {
+			h.out = h.out[:copy(h.out, h.out[n:])]
+		}
+		if err == nil || err == unix.EINTR {
+			continue
+		}
+		if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
+			return
+		}
+		h.outErr = err
+		break
+	}
+	if h.fd < 0 || h.outErr != nil {
+		h.out = h.out[:0]
+	}
+}
+
+func (h *sslHandle) handshake() {
+	h.step <- h.conn.Handshake()
+}
+
+func (h *sslHandle) wait() {
+	var err = <-h.step
+	switch err {
+	case errWantRead:
+		h.state = tlsParked
+	case nil:
+		h.state = tlsDone
+	default:
+		h.state = tlsFailed
+	}
+}
+
+// socket errors are SSL_ERROR_SYSCALL like with OpenSSL
+func sslErrno(err error) int {
+	var errno unix.Errno
+	if errors.As(err, &errno) {
+		return SSL_ERROR_SYSCALL
+	}
+	return SSL_ERROR_SSL
+}
+
+// loads a certificate and its key, the errors tell which file is wrong like those of OpenSSL
+func loadCertificate(certFile string, keyFile string) (tls.Certificate, error) {
+	var certPEM, err = os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, tlsError(ErrorSSLCertificate, certFile, err)
+	}
+	var keyPEM []byte
+	if keyPEM, err = os.ReadFile(keyFile); err != nil {
+		return tls.Certificate{}, tlsError(ErrorSSLPrivateKey, keyFile, err)
+	}
+	var cert tls.Certificate
+	if cert, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		if !hasPEMBlock(certPEM, "CERTIFICATE") {
+			return cert, tlsError(ErrorSSLCertificate, certFile, err)
+		}
+		return cert, tlsError(ErrorSSLPrivateKey, keyFile, err)
+	}
+	return cert, nil
+}
+
+func newSSLCtx(certFile string, keyFile string, opts sslOptions) (*sslCtx, error) {
+	var cert, err = loadCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var ctx = &sslCtx{config: &tls.Config{Certificates: []tls.Certificate{cert}}}
+
+	if err = setSSLVerify(ctx, opts.verify); err != nil {
+		return nil, err
+	}
+
+	if err = setSSLConfig(ctx, opts.config, opts.tickets); err != nil {
+		return nil, err
+	}
+
+	setALPN(ctx, opts.alpn)
+
+	return ctx, nil
+}
+
+// adds the file and the cause, errors.Is(err, base) still holds
+func tlsError(base error, file string, err error) error {
+	if file != "" {
+		base = fmt.Errorf("%w %s", base, file)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", base, err.Error())
+	}
+	return base
+}
+
+// handshakes still running keep their tls.Config
+func freeSSLCtx(ctx *sslCtx) {
+	if ctx != nil && ctx.tickets != nil {
+		ctx.tickets.detach(ctx.config)
+	}
+}
+
+func newSSLHandle(ctx *sslCtx) *sslHandle {
+	return &sslHandle{ctx: ctx, fd: -1}
+}
+
+func freeSSLHandle(ssl *sslHandle) {
+	clearSSLHandle(ssl)
+}
+
+func setSSLFd(ssl *sslHandle, fd int) bool {
+	ssl.fd = fd
+	return true
+}
+
+// stops a parked handshake goroutine, anything it still sends is dropped
+func clearSSLHandle(ssl *sslHandle) {
+	if ssl.state == tlsParked {
+		ssl.fd = -1
+		ssl.resume <- false
+		<-ssl.step
+	}
+	ssl.outLock.Lock()
+	ssl.fd = -1
+	ssl.out = ssl.out[:0]
+	ssl.outErr = nil
+	ssl.outLock.Unlock()
+	ssl.conn = nil
+	ssl.state = tlsIdle
+	ssl.step = nil
+	ssl.resume = nil
+	ssl.errno = SSL_ERROR_NONE
+	ssl.written = 0
+}
+
+// the SNI certificate is picked by tls.Config.GetCertificate, nothing to switch back
+func resetSSLCtx(ssl *sslHandle, ctx *sslCtx) {
+}
+
+func GetSSLErrorNumber(ssl *sslHandle, ret int) int {
+	return ssl.errno
+}
+
+func sslAccept(ssl *sslHandle) (int, int) {
+	if pending, err := ssl.flush(); err != nil {
+		return -1, sslErrno(err)
+	} else if pending {
+		return -1, SSL_ERROR_WANT_WRITE
+	}
+
+	switch ssl.state {
+	case tlsIdle:
+		ssl.conn = tls.Server(fdConn{h: ssl}, ssl.ctx.config)
+		ssl.step = make(chan error)
+		ssl.resume = make(chan bool)
+		ssl.state = tlsRunning
+		go ssl.handshake()
+		ssl.wait()
+	case tlsParked:
+		ssl.state = tlsRunning
+		ssl.resume <- true
+		ssl.wait()
+	}
+
+	if ssl.state == tlsFailed {
+		return -1, SSL_ERROR_SSL
+	}
+	if pending, err := ssl.flush(); err != nil {
+		return -1, sslErrno(err)
+	} else if pending {
+		return -1, SSL_ERROR_WANT_WRITE
+	}
+	if ssl.state == tlsParked {
+		return -1, SSL_ERROR_WANT_READ
+	}
+	return 1, SSL_ERROR_NONE
+}
+
+// runs on the event loop, the result is also kept for GetSSLErrorNumber
+func sslRead(ssl *sslHandle, buffer []byte, n int) (int, int) {
+	if ssl.state != tlsDone {
+		ssl.errno = SSL_ERROR_SSL
+		return -1, ssl.errno
+	}
+	var ret, err = ssl.conn.Read(buffer[:n])
+	switch {
+	case ret > 0:
+		ssl.errno = SSL_ERROR_NONE
+		return ret, ssl.errno
+	case err == io.EOF:
+		ssl.errno = SSL_ERROR_ZERO_RETURN
+		return 0, ssl.errno
+	case err == nil:
+		ssl.errno = SSL_ERROR_WANT_READ
+	default:
+		if _, ok := err.(wouldBlock); ok {
+			ssl.errno = SSL_ERROR_WANT_READ
+		} else {
+			ssl.errno = sslErrno(err)
+		}
+	}
+	return -1, ssl.errno
+}
+
+// like SSL_write after SSL_ERROR_WANT_WRITE, the call has to be repeated with the same buffer,
+// it then returns once the records of the first call have been written
+func sslWrite(ssl *sslHandle, buffer []byte, n int) (int, int) {
+	if ssl.state != tlsDone {
+		return -1, SSL_ERROR_SSL
+	}
+	if pending, err := ssl.flush(); err != nil {
+		return -1, sslErrno(err)
+	} else if pending {
+		return -1, SSL_ERROR_WANT_WRITE
+	}
+	if ssl.written > 0 {
+		var ret = ssl.written
+		ssl.written = 0
+		return ret, SSL_ERROR_NONE
+	}
+
+	var ret, err = ssl.conn.Write(buffer[:n])
+	if err != nil {
+		return -1, sslErrno(err)
+	}
+	if pending, _ := ssl.flush(); pending {
+		ssl.written = ret
+		return -1, SSL_ERROR_WANT_WRITE
+	}
+	return ret, SSL_ERROR_NONE
+}
+
+func sslServerName(ssl *sslHandle) string {
+	return ssl.conn.ConnectionState().ServerName
+}
+
+func sslSelectedProtocol(ssl *sslHandle) string {
+	return ssl.conn.ConnectionState().NegotiatedProtocol
+}
+
+// DER of the client certificate followed by the chain it sent, nil without a client certificate
+func sslPeerChain(ssl *sslHandle) [][]byte {
+	var certs = ssl.conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	var chain = make([][]byte, 0, len(certs))
+	var i int
+	for i = range certs {
+		chain = append(chain, certs[i].Raw)
+	}
+	return chain
+}
+
+// crypto/tls does not export the traffic keys
+func sslKTLS(ssl *sslHandle) (bool, bool) {
+	return false, false
+}
+
+// there is no C heap to trim
+func cMallocTrim() {
+}
+
+func cMallocTrimLoop() {
+}
@@ -0,0 +1,404 @@
+//go:build !cgo || gotls
+// +build !cgo gotls
+
+package epoll
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNoCertificates = errors.New("no certificates found")
+	errNoCRL          = errors.New("no CRL found")
+	errCRLMissing     = errors.New("unable to get certificate CRL")
+	errCRLExpired     = errors.New("CRL has expired")
+	errRevoked        = errors.New("certificate revoked")
+	errChainTooLong   = errors.New("certificate chain too long")
+)
+
+func hasPEMBlock(data []byte, blockType string) bool {
+	var block *pem.Block
+	for {
+		if block, data = pem.Decode(data); block == nil {
+			return false
+		}
+		if block.Type == blockType {
+			return true
+		}
+	}
+}
+
+// the certificate of the default context is replaced by that of the name the client sends with SNI
+// certificates used for several names are loaded once
+func newSNISSLCtx(certs *SSLCertificates, opts sslOptions) (*sslCtx, error) {
+	var ctx, err = newSSLCtx(certs.Default.CertFile, certs.Default.KeyFile, opts)
+	if err != nil || len(certs.Names) == 0 {
+		return ctx, err
+	}
+
+	var loaded = map[SSLCertificate]*tls.Certificate{certs.Default: &ctx.config.Certificates[0]}
+	var names = make(map[string]*tls.Certificate, len(certs.Names))
+	var name string
+	var cert SSLCertificate
+	for name, cert = range certs.Names {
+		var c, ok = loaded[cert]
+		if !ok {
+			var pair tls.Certificate
+			if pair, err = loadCertificate(cert.CertFile, cert.KeyFile); err != nil {
+				freeSSLCtx(ctx)
+				return nil, err
+			}
+			c = &pair
+			loaded[cert] = c
+		}
+		names[strings.ToLower(strings.TrimSuffix(name, "."))] = c
+	}
+
+	// nil falls back to the default certificate
+	ctx.config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return sniLookup(names, strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))), nil
+	}
+	return ctx, nil
+}
+
+// exact names first, then "*.example.com" for one label in front of example.com
+func sniLookup(names map[string]*tls.Certificate, name string) *tls.Certificate {
+	if name == "" {
+		return nil
+	}
+	if c, ok := names[name]; ok {
+		return c
+	}
+	var dot = strings.IndexByte(name, '.')
+	if dot <= 0 {
+		return nil
+	}
+	return names["*"+name[dot:]]
+}
+
+func setSSLVerify(ctx *sslCtx, v *SSLVerify) error {
+	if v == nil || v.Mode == SSL_VERIFY_NONE {
+		return nil
+	}
+	if err := checkSSLVerify(v); err != nil {
+		return err
+	}
+
+	// without CAs nothing verifies, as with OpenSSL, instead of falling back to the system roots
+	var roots = x509.NewCertPool()
+	if v.CAFile != "" {
+		var data, err = os.ReadFile(v.CAFile)
+		if err != nil {
+			return tlsError(ErrorSSLCA, v.CAFile, err)
+		}
+		if !roots.AppendCertsFromPEM(data) {
+			return tlsError(ErrorSSLCA, v.CAFile, errNoCertificates)
+		}
+	}
+	if v.CAPath != "" {
+		var files, err = os.ReadDir(v.CAPath)
+		if err != nil {
+			return tlsError(ErrorSSLCA, v.CAPath, err)
+		}
+		var i int
+		for i = range files {
+			if files[i].IsDir() {
+				continue
+			}
+			if data, err := os.ReadFile(filepath.Join(v.CAPath, files[i].Name())); err == nil {
+				roots.AppendCertsFromPEM(data)
+			}
+		}
+	}
+	ctx.config.ClientCAs = roots
+
+	if v.Mode == SSL_VERIFY_REQUIRED {
+		ctx.config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		ctx.config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	var crls []*x509.RevocationList
+	if v.CRLFile != "" {
+		var err error
+		if crls, err = loadCRLs(v.CRLFile); err != nil {
+			return tlsError(ErrorSSLCRL, v.CRLFile, err)
+		}
+	}
+	var checkCRL = v.CRLFile != ""
+	if v.Depth <= 0 && !checkCRL {
+		return nil
+	}
+
+	// runs after crypto/tls has built the chains, one of them has to pass
+	// also runs without a client certificate, ClientAuth already decided about that
+	var depth, checkAll = v.Depth, v.CRLCheckAll
+	ctx.config.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return nil
+		}
+		var err = errChainTooLong
+		var chain []*x509.Certificate
+		for _, chain = range chains {
+			// as with OpenSSL, depth counts the intermediates between the client certificate and the trusted root
+			if depth > 0 && len(chain) > depth+2 {
+				continue
+			}
+			if !checkCRL {
+				return nil
+			}
+			if err = checkChainCRL(chain, crls, checkAll); err == nil {
+				return nil
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// PEM or DER
+func loadCRLs(file string) ([]*x509.RevocationList, error) {
+	var data, err = os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var crls []*x509.RevocationList
+	var crl *x509.RevocationList
+	if !hasPEMBlock(data, "X509 CRL") {
+		if crl, err = x509.ParseRevocationList(data); err != nil {
+			return nil, err
+		}
+		return []*x509.RevocationList{crl}, nil
+	}
+	var block *pem.Block
+	for {
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		if crl, err = x509.ParseRevocationList(block.Bytes); err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		return nil, errNoCRL
+	}
+	return crls, nil
+}
+
+// the client certificate, or every certificate below the root with checkAll, needs a CRL of its issuer
+func checkChainCRL(chain []*x509.Certificate, crls []*x509.RevocationList, checkAll bool) error {
+	var n = 1
+	if checkAll {
+		n = len(chain) - 1
+	}
+	var i int
+	for i = 0; i < n && i+1 < len(chain); i++ {
+		if err := checkCRL(chain[i], chain[i+1], crls); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkCRL(cert *x509.Certificate, issuer *x509.Certificate, crls []*x509.RevocationList) error {
+	var crl *x509.RevocationList
+	for _, crl = range crls {
+		if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) || crl.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			return errCRLExpired
+		}
+		var i int
+		var revoked = crl.RevokedCertificateEntries
+		for i = range revoked {
+			if revoked[i].SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return errRevoked
+			}
+		}
+		return nil
+	}
+	return errCRLMissing
+}
+
+func setALPN(ctx *sslCtx, protocols []string) {
+	if len(protocols) == 0 {
+		return
+	}
+	ctx.config.NextProtos = protocols
+}
+
+// OpenSSL names of the suites crypto/tls implements, IANA names are accepted as well
+var opensslCipherNames = map[string]string{
+	"ECDHE-ECDSA-AES128-GCM-SHA256": "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	"ECDHE-RSA-AES128-GCM-SHA256":   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	"ECDHE-ECDSA-AES256-GCM-SHA384": "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	"ECDHE-RSA-AES256-GCM-SHA384":   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	"ECDHE-ECDSA-CHACHA20-POLY1305": "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	"ECDHE-RSA-CHACHA20-POLY1305":   "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+	"ECDHE-ECDSA-AES128-SHA256":     "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+	"ECDHE-RSA-AES128-SHA256":       "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+	"ECDHE-ECDSA-AES128-SHA":        "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	"ECDHE-RSA-AES128-SHA":          "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	"ECDHE-ECDSA-AES256-SHA":        "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	"ECDHE-RSA-AES256-SHA":          "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	"AES128-GCM-SHA256":             "TLS_RSA_WITH_AES_128_GCM_SHA256",
+	"AES256-GCM-SHA384":             "TLS_RSA_WITH_AES_256_GCM_SHA384",
+	"AES128-SHA256":                 "TLS_RSA_WITH_AES_128_CBC_SHA256",
+	"AES128-SHA":                    "TLS_RSA_WITH_AES_128_CBC_SHA",
+	"AES256-SHA":                    "TLS_RSA_WITH_AES_256_CBC_SHA",
+	"ECDHE-RSA-DES-CBC3-SHA":        "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA",
+	"DES-CBC3-SHA":                  "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+}
+
+var groupNames = map[string]tls.CurveID{
+	"x25519":     tls.X25519,
+	"p-256":      tls.CurveP256,
+	"prime256v1": tls.CurveP256,
+	"secp256r1":  tls.CurveP256,
+	"p-384":      tls.CurveP384,
+	"secp384r1":  tls.CurveP384,
+	"p-521":      tls.CurveP521,
+	"secp521r1":  tls.CurveP521,
+}
+
+func cipherSuites() map[string]*tls.CipherSuite {
+	var suites = make(map[string]*tls.CipherSuite)
+	var s *tls.CipherSuite
+	for _, s = range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[s.Name] = s
+	}
+	return suites
+}
+
+func isTLS13Suite(s *tls.CipherSuite) bool {
+	return len(s.SupportedVersions) == 1 && s.SupportedVersions[0] == tls.VersionTLS13
+}
+
+func splitNames(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ':' || r == ',' || r == ' '
+	})
+}
+
+func setSSLConfig(ctx *sslCtx, c *SSLConfig, tickets *sessionTickets) error {
+	if c == nil {
+		return nil
+	}
+	var config = ctx.config
+
+	if c.MinVersion != 0 && (c.MinVersion < TLS_VERSION_1_0 || c.MinVersion > TLS_VERSION_1_3) ||
+		c.MaxVersion != 0 && (c.MaxVersion < TLS_VERSION_1_0 || c.MaxVersion > TLS_VERSION_1_3) ||
+		c.MinVersion != 0 && c.MaxVersion != 0 && c.MinVersion > c.MaxVersion {
+		return tlsError(ErrorSSLConfig, "MinVersion/MaxVersion", nil)
+	}
+	config.MinVersion = uint16(c.MinVersion)
+	config.MaxVersion = uint16(c.MaxVersion)
+
+	var suites = cipherSuites()
+	var name string
+	if c.Ciphers != "" {
+		for _, name = range splitNames(c.Ciphers) {
+			var s, ok = suites[name]
+			if !ok {
+				s, ok = suites[opensslCipherNames[name]]
+			}
+			if !ok {
+				return tlsError(ErrorSSLConfig, "Ciphers "+c.Ciphers, nil)
+			}
+			config.CipherSuites = append(config.CipherSuites, s.ID)
+		}
+	}
+
+	// checked only, crypto/tls does not configure TLS 1.3 suites
+	for _, name = range splitNames(c.CipherSuites) {
+		if s, ok := suites[name]; !ok || !isTLS13Suite(s) {
+			return tlsError(ErrorSSLConfig, "CipherSuites "+c.CipherSuites, nil)
+		}
+	}
+
+	for _, name = range splitNames(c.Groups) {
+		var id, ok = groupNames[strings.ToLower(name)]
+		if !ok {
+			return tlsError(ErrorSSLConfig, "Groups "+c.Groups, nil)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, id)
+	}
+
+	config.PreferServerCipherSuites = c.PreferServerCiphers
+	config.SessionTicketsDisabled = c.DisableSessionTickets
+
+	if tickets != nil && !c.DisableSessionTickets {
+		tickets.attach(config)
+		ctx.tickets = tickets
+	}
+	return nil
+}
+
+// keys used for session tickets by every context of the EP, so tickets survive SNI switches and ReloadCertificates
+// keys[0] encrypts, keys[1] is the previous key
+type sessionTickets struct {
+	keys    [][32]byte
+	configs map[*tls.Config]bool
+	lock    sync.Mutex
+}
+
+func newSessionTickets() (*sessionTickets, error) {
+	var t = &sessionTickets{configs: make(map[*tls.Config]bool)}
+	if err := t.rotate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *sessionTickets) rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return tlsError(ErrorSSLConfig, "TicketKeyRotation", err)
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.keys = append([][32]byte{key}, t.keys...)
+	if len(t.keys) > 2 {
+		t.keys = t.keys[:2]
+	}
+	var config *tls.Config
+	for config = range t.configs {
+		config.SetSessionTicketKeys(t.keys)
+	}
+	return nil
+}
+
+func (t *sessionTickets) attach(config *tls.Config) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.configs[config] = true
+	config.SetSessionTicketKeys(t.keys)
+}
+
+func (t *sessionTickets) detach(config *tls.Config) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.configs, config)
+}
+
+// contexts keep the keys they have, they are no longer rotated
+func (t *sessionTickets) release() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.configs = make(map[*tls.Config]bool)
+}
@@ -0,0 +1,36 @@
+//go:build !cgo || gotls
+// +build !cgo gotls
+
+package epoll
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestSNILookup(t *testing.T) {
+	var exact, wildcard = &tls.Certificate{}, &tls.Certificate{}
+	var names = map[string]*tls.Certificate{
+		"exact.example.com": exact,
+		"*.example.com":     wildcard,
+		"*.sub.example.com": wildcard,
+	}
+	var tests = []struct {
+		name string
+		want *tls.Certificate
+	}{
+		{"exact.example.com", exact},
+		{"other.example.com", wildcard},
+		{"a.sub.example.com", wildcard},
+		{"a.b.example.com", nil},
+		{"example.com", nil},
+		{".example.com", nil},
+		{"localhost", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if c := sniLookup(names, tt.name); c != tt.want {
+			t.Errorf("%q: %p, want %p", tt.name, c, tt.want)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !cgo || gotls
+// +build !cgo gotls
+
+package epoll
+
+import (
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func countHandshakeGoroutines() int {
+	var buf = make([]byte, 1<<20)
+	return strings.Count(string(buf[:runtime.Stack(buf, true)]), "(*sslHandle).handshake(")
+}
+
+// the goroutine of a handshake parked for lack of data exits when the connection is closed
+func TestSSLHandshakeAborted(t *testing.T) {
+	var p = newTestPKI(t)
+	var certFile, keyFile, _ = p.issue(t, "server", []string{"localhost"}, false)
+
+	var ep = newEchoEP(t)
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListenerSSL("127.0.0.1", 0, certFile, keyFile, nil)
+	})
+
+	var c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the start of a ClientHello, crypto/tls waits for the rest
+	c.Write([]byte{0x16, 0x03, 0x01, 0x01, 0x00, 0x01})
+	waitUntil(t, "the handshake to park", func() bool { return countHandshakeGoroutines() == 1 })
+	c.Close()
+	waitUntil(t, "the handshake goroutine to exit", func() bool { return countHandshakeGoroutines() == 0 })
+	waitUntil(t, "the connection to close", func() bool { return ep.Stats().Connections == 0 })
+}
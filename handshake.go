@@ -0,0 +1,177 @@
+package epoll
+
+import (
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	HANDSHAKE_NONE       = 0
+	HANDSHAKE_WANT_READ  = 1
+	HANDSHAKE_WANT_WRITE = 2
+	HANDSHAKE_EXPIRED    = 3
+)
+
+func (ep *EP) startHandshake(fd int, conn *Conn) {
+	atomic.StoreInt32(&conn.handshake, HANDSHAKE_WANT_READ)
+	if ep.HandshakeTimeout > 0 {
+		conn.hsTimer = time.AfterFunc(time.Duration(ep.HandshakeTimeout)*time.Second, func() {
+			ep.expireHandshake(fd, conn)
+		})
+	}
+}
+
+// wakes up the event loop, which then fails the handshake on its own goroutine
+func (ep *EP) expireHandshake(fd int, conn *Conn) {
+	ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+		var c, ok = value.(*Conn)
+		if !ok || c != conn {
+			return
+		}
+		// the event loop moves between the other states with CompareAndSwap, so it notices the expiry
+		var state int32
+		for {
+			if state = atomic.LoadInt32(&c.handshake); state == HANDSHAKE_NONE || state == HANDSHAKE_EXPIRED {
+				return
+			}
+			if atomic.CompareAndSwapInt32(&c.handshake, state, HANDSHAKE_EXPIRED) {
+				unix.Shutdown(fd, unix.SHUT_RDWR)
+				return
+			}
+		}
+	})
+}
+
+// runs on the event loop, returns whether the handshake has completed
+// and whether the connection is still open
+func (ep *EP) handshake(fd int, conn *Conn) (bool, bool) {
+	var state = atomic.LoadInt32(&conn.handshake)
+	if state == HANDSHAKE_EXPIRED {
+		ep.failHandshake(fd, conn, ErrorSSLHandshakeTimeout)
+		return false, false
+	}
+	var ktlsSend, ktlsRecv bool
+	var serverName string
+	var peerCerts [][]byte
+	var protocol string
+	conn.outLock.Lock()
+	var generation = conn.Generation
+	conn.outLock.Unlock()
+	conn.sslLock.Lock()
+	if conn.SSL == nil {
+		conn.sslLock.Unlock()
+		return false, false
+	}
+	var ret, errno = sslAccept(conn.SSL.SSL)
+	if ret == 1 {
+		serverName = sslServerName(conn.SSL.SSL)
+		peerCerts = sslPeerChain(conn.SSL.SSL)
+		ktlsSend, ktlsRecv = sslKTLS(conn.SSL.SSL)
+		protocol = sslSelectedProtocol(conn.SSL.SSL)
+	}
+	conn.sslLock.Unlock()
+
+	if ret == 1 {
+		if conn.hsTimer != nil {
+			conn.hsTimer.Stop()
+		}
+		if !atomic.CompareAndSwapInt32(&conn.handshake, state, HANDSHAKE_NONE) {
+			ep.failHandshake(fd, conn, ErrorSSLHandshakeTimeout)
+			return false, false
+		}
+		// the getters read these under the map lock
+		var found bool
+		ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+			var c, ok = value.(*Conn)
+			if found = ok && c == conn && c.Generation == generation; found {
+				c.ServerName = serverName
+				c.peerCerts = peerCerts
+				ep.routeProtocol(c, protocol)
+				// send and flush read the flags under outLock alone
+				c.outLock.Lock()
+				c.ktlsSend, c.ktlsRecv = ktlsSend, ktlsRecv
+				c.outLock.Unlock()
+			}
+		})
+		if !found {
+			return false, false
+		}
+		// data sent during the handshake has been queued, EPOLLOUT stays on until flush has written it
+		ep.setReadEvents(conn, true)
+		atomic.AddUint64(&ep.metrics.handshakes, 1)
+		if ep.getCallbacks(conn.callbacks).hasAccept() {
+			ep.invoke(conn.SequenceId, ep.getRequestItemForAccepted(conn, conn.SequenceId, fd))
+		}
+		return true, true
+	}
+	var next int32
+	switch errno {
+	case SSL_ERROR_WANT_READ:
+		next = HANDSHAKE_WANT_READ
+	case SSL_ERROR_WANT_WRITE:
+		next = HANDSHAKE_WANT_WRITE
+	default:
+		ep.failHandshake(fd, conn, GetSSLError(errno))
+		return false, false
+	}
+	if !atomic.CompareAndSwapInt32(&conn.handshake, state, next) {
+		ep.failHandshake(fd, conn, ErrorSSLHandshakeTimeout)
+		return false, false
+	}
+	if state == HANDSHAKE_WANT_WRITE && next == HANDSHAKE_WANT_READ {
+		ep.DisableEpollOut(fd)
+	} else if state != HANDSHAKE_WANT_WRITE && next == HANDSHAKE_WANT_WRITE {
+		ep.EnableEpollOut(fd)
+	}
+	return false, true
+}
+
+func (ep *EP) failHandshake(fd int, conn *Conn, err error) {
+	if ep.dropConnection(fd, conn, CLOSE_REASON_HANDSHAKE, ERROR_SSL_HANDSHAKE, err) {
+		atomic.AddUint64(&ep.metrics.handshakeFailures, 1)
+		if err == ErrorSSLHandshakeTimeout {
+			atomic.AddUint64(&ep.metrics.handshakeTimeouts, 1)
+		}
+	}
+}
+
+// closes a connection OnAccept has not been called for, so OnClose is not called either
+// err is passed to OnError unless it is nil, returns false if the connection was already gone
+func (ep *EP) dropConnection(fd int, conn *Conn, reason CloseReason, code ErrorCode, err error) bool {
+	var sequenceId = conn.SequenceId
+	var cb = ep.getCallbacks(conn.callbacks)
+	if ep.Delete(fd) != nil {
+		return false
+	}
+	ep.countClose(reason)
+	var req *Request
+	if err != nil {
+		ep.countError(code)
+		if cb.hasError() {
+			req = ep.getRequestItemForError(conn, fd, code, err)
+		}
+	}
+	ep.DeleteConnection(fd)
+	ep.CloseFd(fd)
+	if req != nil {
+		ep.invoke(sequenceId, req)
+	}
+	return true
+}
+
+// dropConnection off the event loop, the fd is removed from epoll under the map lock
+// so a connection that has meanwhile been closed and replaced is left alone
+func (ep *EP) dropConnectionByID(id ConnID, reason CloseReason) bool {
+	var delErr error
+	if err := ep.updateByID(id, func(c *Conn) {
+		delErr = unix.EpollCtl(ep.connEpfd(c), unix.EPOLL_CTL_DEL, c.Fd, nil)
+	}); err != nil || delErr != nil {
+		return false
+	}
+	ep.countClose(reason)
+	ep.DeleteConnection(id.Fd())
+	ep.CloseFd(id.Fd())
+	return true
+}
@@ -0,0 +1,78 @@
+package epoll
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_IDLE_CHECK_INTERVAL = 1
+)
+
+// seconds without activity before a connection is closed, or OnIdle fires if set, 0 disables it
+func (ep *EP) SetIdleTimeout(n int) {
+	ep.IdleTimeout = n
+}
+
+func (ep *EP) idleLoop() {
+	go func() {
+		var timer = time.NewTicker(DEFAULT_IDLE_CHECK_INTERVAL * time.Second)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ep.done:
+				return
+			case <-timer.C:
+				if ep.IdleTimeout > 0 {
+					ep.sweepIdle()
+				}
+			}
+		}
+	}()
+}
+
+func (ep *EP) sweepIdle() {
+	var deadline = time.Now().Unix() - int64(ep.IdleTimeout)
+	var idles, pending []ConnID
+	ep.Connections.Iterate(func(key interface{}, value interface{}) {
+		var c, ok = value.(*Conn)
+		if ok && c.Timestamp <= deadline {
+			if atomic.LoadInt32(&c.handshake) == HANDSHAKE_NONE {
+				idles = append(idles, c.ConnID())
+			} else {
+				pending = append(pending, c.ConnID())
+			}
+		}
+	})
+
+	var id ConnID
+	// still in the TLS handshake or waiting for the PROXY header, OnAccept has not been called for them
+	for _, id = range pending {
+		ep.dropConnectionByID(id, CLOSE_REASON_IDLE)
+	}
+
+	// the Conn may have been closed and reused for another fd since the first pass, only its handle tells
+	var sequenceId int
+	var req *Request
+	for _, id = range idles {
+		sequenceId, req = -1, nil
+		ep.Connections.UpdateWithFunc(id.Fd(), func(value interface{}) {
+			var c, ok = value.(*Conn)
+			if ok && c.Generation == id.Generation() && c.Timestamp <= deadline {
+				c.Timestamp = time.Now().Unix()
+				sequenceId = c.SequenceId
+				if ep.getCallbacks(c.callbacks).hasIdle() {
+					req = ep.getRequestItemForIdle(c, sequenceId, id.Fd())
+				}
+			}
+		})
+		if sequenceId < 0 {
+			continue
+		}
+		if req != nil {
+			ep.invoke(sequenceId, req)
+		} else {
+			ep.closeAction(CLOSE_REASON_IDLE, sequenceId, id.Fd())
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package epoll
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// an idle connection is closed without OnIdle and kept with it, active ones and fresh handshakes are left alone
+func TestIdle(t *testing.T) {
+	var tests = []struct {
+		name   string
+		onIdle bool
+	}{
+		{"close", false},
+		{"OnIdle", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ep = newEchoEP(t)
+			ep.SetIdleTimeout(60)
+			var accepted = make(chan ConnID, 2)
+			var idle = make(chan ConnID, 2)
+			var closed = make(chan ConnID, 2)
+			ep.OnAcceptID = func(id ConnID) { accepted <- id }
+			ep.OnCloseID = func(id ConnID) { closed <- id }
+			if tt.onIdle {
+				ep.OnIdleID = func(id ConnID) { idle <- id }
+			}
+			var addr = serveTest(t, ep, func() (*Listener, error) {
+				return ep.AddListener("127.0.0.1", 0, nil)
+			})
+
+			var c net.Conn
+			var id = acceptID(t, accepted, addr, &c)
+			defer c.Close()
+			var active = acceptID(t, accepted, addr, nil)
+			backdate(t, ep, id)
+			ep.sweepIdle()
+
+			if tt.onIdle {
+				select {
+				case got := <-idle:
+					if got != id {
+						t.Fatalf("OnIdle for %x, want %x", got, id)
+					}
+				case <-time.After(testTimeout):
+					t.Fatal("timed out waiting for OnIdle")
+				}
+				// the timestamp was refreshed, the next sweep leaves it alone
+				ep.sweepIdle()
+				echo(t, c, "still open")
+				select {
+				case got := <-idle:
+					t.Fatalf("OnIdle again for %x", got)
+				case got := <-closed:
+					t.Fatalf("%x closed", got)
+				default:
+				}
+				return
+			}
+
+			select {
+			case got := <-closed:
+				if got != id {
+					t.Fatalf("closed %x, want %x", got, id)
+				}
+			case <-time.After(testTimeout):
+				t.Fatal("timed out waiting for OnClose")
+			}
+			if _, err := c.Read(make([]byte, 1)); err == nil {
+				t.Fatal("idle connection still open")
+			}
+			if _, err := ep.GetConnectionByID(active); err != nil {
+				t.Fatalf("active connection: %v", err)
+			}
+		})
+	}
+}
+
+// a connection still waiting for its PROXY header is dropped without OnAccept or OnClose
+func TestIdleHandshake(t *testing.T) {
+	var ep = newTestEP(t)
+	ep.SetIdleTimeout(60)
+	ep.SetProxyProtocol(true)
+	ep.OnAccept = func(fd int) { t.Errorf("OnAccept without a PROXY header") }
+	ep.OnClose = func(fd int) { t.Errorf("OnClose for a connection never accepted") }
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListener("127.0.0.1", 0, nil)
+	})
+
+	var c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(testTimeout))
+	var id ConnID
+	waitUntil(t, "the connection", func() bool {
+		ep.Connections.Iterate(func(key interface{}, value interface{}) {
+			if conn, ok := value.(*Conn); ok {
+				id = conn.ConnID()
+			}
+		})
+		return id != 0
+	})
+	backdate(t, ep, id)
+	ep.sweepIdle()
+	if _, err = c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection still open")
+	}
+}
+
+// moves the last activity of id back by twice the idle timeout
+func backdate(t *testing.T, ep *EP, id ConnID) {
+	if err := ep.updateByID(id, func(c *Conn) {
+		c.Timestamp -= int64(2 * ep.IdleTimeout)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
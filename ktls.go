@@ -0,0 +1,22 @@
+package epoll
+
+// installs the keys negotiated by the handshake into the socket with the kernel TLS module (TCP_ULP "tls"),
+// reads and writes then go to the fd directly, connections stay in user space when the kernel, the cipher
+// or the OpenSSL build does not support it, the crypto/tls backend cannot export its keys and never offloads
+// takes effect for TLS listeners started afterwards, those already running keep their setting across reloads
+func (ep *EP) SetKTLS(enabled bool) {
+	ep.sslOptions.ktls = enabled
+}
+
+// whether the kernel encrypts the records sent on the connection and decrypts those received,
+// set once the handshake has completed, so it can be used in OnAccept
+func (ep *EP) GetConnectionKTLS(fd int) (bool, bool) {
+	var send, recv bool
+	ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+		var c, ok = value.(*Conn)
+		if ok {
+			send, recv = c.ktlsSend, c.ktlsRecv
+		}
+	})
+	return send, recv
+}
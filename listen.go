@@ -5,32 +5,71 @@ import (
 )
 
 func (ep *EP) listen() {
+	var r *reactor
+	if !ep.addLoops() {
+		return
+	}
+	ep.idleLoop()
+	ep.certWatchLoop()
+	ep.ticketLoop()
+	for _, r = range ep.reactors[1:] {
+		go ep.loop(r)
+	}
+	ep.loop(ep.reactors[0])
+}
+
+// counts the loops before they start, false if Stop came first, whose Wait must not see the count grow
+func (ep *EP) addLoops() bool {
+	ep.stopLock.Lock()
+	defer ep.stopLock.Unlock()
+	if ep.isStopped() {
+		return false
+	}
+	ep.loops.Add(len(ep.reactors))
+	return true
+}
+
+func (ep *EP) loop(r *reactor) {
 	var err error
 	var i, n int
 	var fd int
+	var l *Listener
 	var events = make([]unix.EpollEvent, ep.EpollEvents)
+	defer ep.loops.Done()
 	for {
-		n, err = unix.EpollWait(ep.Epfd, events, ep.WaitTimeout)
+		n, err = unix.EpollWait(r.epfd, events, ep.WaitTimeout)
 		if err == nil {
+			ep.countEpollWait(n)
 			for i = 0; i < n; i++ {
 				fd = int(events[i].Fd)
-				if fd == ep.Fd {
-					ep.InvokeAccept()
-				} else if events[i].Events&unix.EPOLLIN != 0 {
-					ep.read(fd)
-				} else if events[i].Events&unix.EPOLLOUT != 0 {
-					if ep.OnEpollOut != nil {
-						ep.InvokeEpollOut(fd)
+				if l = ep.getListener(fd); l != nil {
+					ep.invokeAccept(l)
+				} else if fd == r.wakeFd {
+					if ep.isStopped() {
+						return
+					}
+					ep.resumeReads(r)
+				} else if ep.isDialing(fd) {
+					ep.connect(fd)
+				} else if events[i].Events&(unix.EPOLLIN|unix.EPOLLOUT) != 0 {
+					if events[i].Events&unix.EPOLLIN != 0 && !ep.read(fd) {
+						continue
+					}
+					if events[i].Events&unix.EPOLLOUT != 0 {
+						ep.writable(fd)
 					}
 				} else {
 					if fd > 0 {
-						ep.CloseAction(-1, fd)
+						ep.closeAction(CLOSE_REASON_ERROR, -1, fd)
 					}
 				}
 			}
 		} else {
+			if ep.isStopped() {
+				return
+			}
 			if err != unix.EINTR {
-				ep.InvokeError(-1, -1, ERROR_EPOLL_WAIT, err)
+				ep.reportError(-1, -1, ERROR_EPOLL_WAIT, err)
 				break
 			}
 		}
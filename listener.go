@@ -0,0 +1,223 @@
+package epoll
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// adds another listening socket to the EP, callbacks may be nil to use the callbacks of the EP
+func (ep *EP) AddListener(host string, port int, callbacks *Callbacks) (*Listener, error) {
+	var n = len(ep.getListeners())
+	var l, err = ep.newTCPListener(host, port)
+	if err != nil {
+		return nil, newStartError("listen", joinHostPort(host, port), err)
+	}
+	l.Callbacks = callbacks
+	if err = ep.addListeners(l); err != nil {
+		ep.removeListenersFrom(n)
+		return nil, newStartError("listen", joinHostPort(host, port), err)
+	}
+	return l, nil
+}
+
+func (ep *EP) AddListenerSSL(host string, port int, certFile string, keyFile string, callbacks *Callbacks) (*Listener, error) {
+	return ep.AddListenerSSLCertificates(host, port, &SSLCertificates{Default: SSLCertificate{CertFile: certFile, KeyFile: keyFile}}, callbacks)
+}
+
+// like AddListenerSSL, with a certificate per server name, see SSLCertificates
+func (ep *EP) AddListenerSSLCertificates(host string, port int, certs *SSLCertificates, callbacks *Callbacks) (*Listener, error) {
+	var opts = ep.sslOptions
+	var ctx, err = newSNISSLCtx(certs, opts)
+	if err != nil {
+		return nil, newStartError("ssl", joinHostPort(host, port), err)
+	}
+	var n = len(ep.getListeners())
+	var l *Listener
+	if l, err = ep.newTCPListener(host, port); err != nil {
+		freeSSLCtx(ctx)
+		return nil, newStartError("listen", joinHostPort(host, port), err)
+	}
+	l.Callbacks = callbacks
+	l.IsSSL = true
+	l.SSLCtx = ctx
+	l.sslContext = newSSLContext(ctx, certs, opts)
+	l.sslPool = ep.newSSLPool(l.sslContext, ep.Threads*DEFAULT_POOL_MULTIPLE)
+	if err = ep.addListeners(l); err != nil {
+		ep.removeListenersFrom(n)
+		closeSSLPool(l.sslPool)
+		freeSSLCtx(ctx)
+		return nil, newStartError("listen", joinHostPort(host, port), err)
+	}
+	ep.enableSSL(l.sslPool)
+	return l, nil
+}
+
+func (ep *EP) AddListenerUnix(path string, sockType int, callbacks *Callbacks) (*Listener, error) {
+	var n = len(ep.getListeners())
+	var l, err = ep.newUnixListener(path, sockType)
+	if err != nil {
+		return nil, newStartError("listen", path, err)
+	}
+	l.Callbacks = callbacks
+	if err = ep.addListener(l); err != nil {
+		ep.removeListenersFrom(n)
+		return nil, newStartError("listen", path, err)
+	}
+	return l, nil
+}
+
+// adds l and its SO_REUSEPORT copies
+func (ep *EP) addListeners(l *Listener) error {
+	var err error
+	if ep.ReactorMode == REACTOR_MODE_REUSEPORT && l.reactor == nil {
+		// connections stay on the loop of the socket that accepted them, the copies serve the other loops
+		l.reactor = ep.reactors[0]
+	}
+	if err = ep.addListener(l); err != nil {
+		return err
+	}
+	return ep.addReusePortListeners(l)
+}
+
+// closes and forgets the listeners added after the first n, used when adding a listener fails halfway
+func (ep *EP) removeListenersFrom(n int) {
+	var l *Listener
+	ep.listenerLock.Lock()
+	defer ep.listenerLock.Unlock()
+	var listeners = ep.getListeners()
+	if n >= len(listeners) {
+		return
+	}
+	for _, l = range listeners[n:] {
+		ep.closeListener(l)
+	}
+	ep.listeners.Store(listeners[:n:n])
+}
+
+// runs with listenerLock held, waits for accepts running on the workers, the fd number could be reused once it is closed
+func (ep *EP) closeListener(l *Listener) {
+	l.fdLock.Lock()
+	var fd = l.Fd
+	l.Fd = -1
+	if fd >= 0 {
+		// before the fd number can be reused by a connection
+		ep.storeListenerFd(fd, nil)
+		unix.EpollCtl(ep.listenerEpfd(l), unix.EPOLL_CTL_DEL, fd, nil)
+		ep.CloseFd(fd)
+	}
+	l.fdLock.Unlock()
+	if fd >= 0 {
+		l.unlinkUnixPath()
+	}
+}
+
+// stored before the fd is added to epoll, so its first event already finds it, and removed again if that fails
+func (ep *EP) addListener(l *Listener) error {
+	var event unix.EpollEvent
+	event.Events = unix.EPOLLIN | unix.EPOLLOUT | unix.EPOLLET
+	event.Fd = int32(l.Fd)
+
+	ep.listenerLock.Lock()
+	defer ep.listenerLock.Unlock()
+
+	var listeners = ep.getListeners()
+	l.Id = len(listeners)
+	ep.listeners.Store(append(listeners[:len(listeners):len(listeners)], l))
+	ep.storeListenerFd(l.Fd, l)
+
+	var err = unix.EpollCtl(ep.listenerEpfd(l), unix.EPOLL_CTL_ADD, l.Fd, &event)
+	if err != nil {
+		ep.listeners.Store(listeners)
+		ep.closeListener(l)
+	}
+	return err
+}
+
+// runs with listenerLock held, a nil l removes fd
+func (ep *EP) storeListenerFd(fd int, l *Listener) {
+	var fds = ep.listenerFds.Load().(map[int]*Listener)
+	var next = make(map[int]*Listener, len(fds)+1)
+	var k int
+	var v *Listener
+	for k, v = range fds {
+		next[k] = v
+	}
+	if l != nil {
+		next[fd] = l
+	} else {
+		delete(next, fd)
+	}
+	ep.listenerFds.Store(next)
+}
+
+func (ep *EP) listenerEpfd(l *Listener) int {
+	if l.reactor != nil {
+		return l.reactor.epfd
+	}
+	return ep.Epfd
+}
+
+func (ep *EP) getListeners() []*Listener {
+	var listeners, _ = ep.listeners.Load().([]*Listener)
+	return listeners
+}
+
+func (ep *EP) getListener(fd int) *Listener {
+	var fds, _ = ep.listenerFds.Load().(map[int]*Listener)
+	return fds[fd]
+}
+
+func (ep *EP) hasSSL() bool {
+	var l *Listener
+	for _, l = range ep.getListeners() {
+		if l.IsSSL {
+			return true
+		}
+	}
+	return ep.IsSSL
+}
+
+func (ep *EP) GetListeners() []*Listener {
+	return ep.getListeners()
+}
+
+// the listener a connection was accepted on, nil for dialed and established connections
+func (ep *EP) GetConnectionListener(fd int) *Listener {
+	var l *Listener
+	ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+		var c, ok = value.(*Conn)
+		if ok {
+			l = c.Listener
+		}
+	})
+	return l
+}
+
+func (ep *EP) closeListeners() {
+	var l *Listener
+	ep.listenerLock.Lock()
+	defer ep.listenerLock.Unlock()
+	for _, l = range ep.getListeners() {
+		ep.closeListener(l)
+	}
+	ep.Fd = -1
+}
+
+// Fd of the EP is changed by the start functions and Shutdown, which may run on other goroutines than InvokeAccept
+func (ep *EP) setListenFd(fd int) {
+	ep.listenerLock.Lock()
+	ep.Fd = fd
+	ep.listenerLock.Unlock()
+}
+
+func (ep *EP) getListenFd() int {
+	ep.listenerLock.Lock()
+	defer ep.listenerLock.Unlock()
+	return ep.Fd
+}
+
+func (ep *EP) getCallbacks(callbacks *Callbacks) *Callbacks {
+	if callbacks != nil {
+		return callbacks
+	}
+	return &ep.Callbacks
+}
@@ -0,0 +1,55 @@
+package epoll
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// each listener dispatches to its own callbacks, a listener without them uses those of the EP
+func TestListenerCallbacks(t *testing.T) {
+	var ep = newEchoEP(t)
+	var upper = &Callbacks{
+		OnReceive: func(fd int, msg []byte, n int) { ep.Send(fd, bytes.ToUpper(msg[:n])) },
+	}
+	var lower = &Callbacks{
+		OnReceive: func(fd int, msg []byte, n int) { ep.Send(fd, bytes.ToLower(msg[:n])) },
+	}
+	var addrs = make([]string, 0, 3)
+	var cb *Callbacks
+	for _, cb = range []*Callbacks{upper, lower, nil} {
+		var l, err = ep.AddListener("127.0.0.1", 0, cb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.Callbacks != cb {
+			t.Fatal("listener without the callbacks it was added with")
+		}
+		addrs = append(addrs, listenerAddr(t, l))
+	}
+	serveTest(t, ep, nil)
+
+	var tests = []struct {
+		addr  string
+		reply string
+	}{
+		{addrs[0], "HELLO"},
+		{addrs[1], "hello"},
+		{addrs[2], "HeLLo"},
+	}
+	for _, tt := range tests {
+		var c, err = net.Dial("tcp", tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(testTimeout))
+		c.Write([]byte("HeLLo"))
+		var buf = make([]byte, 5)
+		if _, err = io.ReadFull(c, buf); err != nil || string(buf) != tt.reply {
+			t.Errorf("%s: reply %q %v, want %q", tt.addr, buf, err, tt.reply)
+		}
+		c.Close()
+	}
+}
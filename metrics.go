@@ -0,0 +1,228 @@
+package epoll
+
+import (
+	"sync/atomic"
+
+	"github.com/wuyongjia/pool"
+)
+
+type CloseReason int
+
+const (
+	CLOSE_REASON_PEER      CloseReason = 0 // the peer closed the connection
+	CLOSE_REASON_ERROR     CloseReason = 1 // read, write or epoll error
+	CLOSE_REASON_IDLE      CloseReason = 2
+	CLOSE_REASON_FRAME     CloseReason = 3 // the codec rejected the data
+	CLOSE_REASON_HANDSHAKE CloseReason = 4 // the SSL handshake failed or timed out
+	CLOSE_REASON_APP       CloseReason = 5 // CloseAction or DestroyConnection
+	CLOSE_REASON_SHUTDOWN  CloseReason = 6
+	CLOSE_REASON_PROXY     CloseReason = 7 // missing or malformed PROXY protocol header
+)
+
+const (
+	closeReasonCount = 8
+	errorCodeCount   = 64 // codes outside 0 to errorCodeCount-1 are counted as ERROR_UNKNOW
+)
+
+// counters are only updated with atomics, so they can stay enabled in production
+type metrics struct {
+	accepts           uint64
+	acceptErrors      uint64
+	acceptRejects     uint64
+	bytesRead         uint64
+	bytesWritten      uint64
+	reads             uint64
+	readWakeups       uint64
+	epollWaits        uint64
+	epollEvents       uint64
+	epollMaxBatch     uint64
+	handshakes        uint64
+	handshakeFailures uint64
+	handshakeTimeouts uint64
+	readPauses        uint64
+	bufferPool        poolMetrics
+	connPool          poolMetrics
+	requestPool       poolMetrics
+	sslPool           poolMetrics
+	closes            [closeReasonCount]uint64
+	errors            [errorCodeCount]uint64
+	unknownErrors     uint64
+}
+
+type poolMetrics struct {
+	gets     uint64
+	allocs   uint64
+	failures uint64
+}
+
+type PoolStats struct {
+	Gets      uint64
+	Hits      uint64 // served by a pooled instance
+	Misses    uint64 // a new instance was allocated
+	Failures  uint64 // the pool was full
+	Instances int
+}
+
+// snapshot returned by Stats, the ratios are left to the caller, e.g. Reads / ReadWakeups
+type Stats struct {
+	Connections       int
+	Accepts           uint64
+	AcceptErrors      uint64
+	AcceptRejects     uint64 // closed by the IP filter, the per IP limit or OnAcceptFilter
+	BytesRead         uint64
+	BytesWritten      uint64
+	Reads             uint64 // reads that returned data
+	ReadWakeups       uint64 // EPOLLIN events handled
+	EpollWaits        uint64
+	EpollEvents       uint64 // events returned by all EpollWait calls
+	EpollMaxBatch     uint64
+	QueueDepth        int   // requests waiting in the thread pool queues
+	Inflight          int64 // requests queued or being handled
+	Handshakes        uint64
+	HandshakeFailures uint64 // including timeouts
+	HandshakeTimeouts uint64
+	ReadPauses        uint64 // times reading was paused by backpressure
+	PausedReads       int    // connections whose reading is paused now
+	BufferPool        PoolStats
+	ConnPool          PoolStats
+	RequestPool       PoolStats
+	SSLPool           PoolStats
+	Closes            map[CloseReason]uint64
+	Errors            map[ErrorCode]uint64
+}
+
+func (ep *EP) Stats() Stats {
+	var m = &ep.metrics
+	var s = Stats{
+		Connections:       ep.GetConnectionCount(),
+		Accepts:           atomic.LoadUint64(&m.accepts),
+		AcceptErrors:      atomic.LoadUint64(&m.acceptErrors),
+		AcceptRejects:     atomic.LoadUint64(&m.acceptRejects),
+		BytesRead:         atomic.LoadUint64(&m.bytesRead),
+		BytesWritten:      atomic.LoadUint64(&m.bytesWritten),
+		Reads:             atomic.LoadUint64(&m.reads),
+		ReadWakeups:       atomic.LoadUint64(&m.readWakeups),
+		EpollWaits:        atomic.LoadUint64(&m.epollWaits),
+		EpollEvents:       atomic.LoadUint64(&m.epollEvents),
+		EpollMaxBatch:     atomic.LoadUint64(&m.epollMaxBatch),
+		QueueDepth:        ep.queueDepth(),
+		Inflight:          atomic.LoadInt64(&ep.inflight),
+		Handshakes:        atomic.LoadUint64(&m.handshakes),
+		HandshakeFailures: atomic.LoadUint64(&m.handshakeFailures),
+		HandshakeTimeouts: atomic.LoadUint64(&m.handshakeTimeouts),
+		ReadPauses:        atomic.LoadUint64(&m.readPauses),
+		PausedReads:       int(atomic.LoadInt32(&ep.pausedCount)),
+		BufferPool:        m.bufferPool.stats(ep.bufferPool.GetInstanceCount()),
+		ConnPool:          m.connPool.stats(ep.connPool.GetInstanceCount()),
+		RequestPool:       m.requestPool.stats(ep.requestPool.GetInstanceCount()),
+		SSLPool:           m.sslPool.stats(ep.sslInstanceCount()),
+		Closes:            make(map[CloseReason]uint64, closeReasonCount),
+		Errors:            make(map[ErrorCode]uint64),
+	}
+	var i int
+	var n uint64
+	for i = range m.closes {
+		s.Closes[CloseReason(i)] = atomic.LoadUint64(&m.closes[i])
+	}
+	for i = range m.errors {
+		if n = atomic.LoadUint64(&m.errors[i]); n > 0 {
+			s.Errors[ErrorCode(i)] = n
+		}
+	}
+	if n = atomic.LoadUint64(&m.unknownErrors); n > 0 {
+		s.Errors[ERROR_UNKNOW] = n
+	}
+	return s
+}
+
+func (p *poolMetrics) stats(instances int) PoolStats {
+	var s = PoolStats{
+		Gets:      atomic.LoadUint64(&p.gets),
+		Misses:    atomic.LoadUint64(&p.allocs),
+		Failures:  atomic.LoadUint64(&p.failures),
+		Instances: instances,
+	}
+	if s.Gets > s.Misses+s.Failures {
+		s.Hits = s.Gets - s.Misses - s.Failures
+	}
+	return s
+}
+
+func (p *poolMetrics) get(err error) {
+	atomic.AddUint64(&p.gets, 1)
+	if err != nil {
+		atomic.AddUint64(&p.failures, 1)
+	}
+}
+
+func (p *poolMetrics) alloc() {
+	atomic.AddUint64(&p.allocs, 1)
+}
+
+func (ep *EP) queueDepth() int {
+	var n int
+	var ch chan interface{}
+	for _, ch = range ep.threadPoolSequence.ArgsList {
+		n += len(ch)
+	}
+	return n
+}
+
+// SSL pools are created per listener and shared by its SO_REUSEPORT copies
+func (ep *EP) sslInstanceCount() int {
+	var n int
+	var l *Listener
+	var seen = make(map[*pool.Pool]bool)
+	for _, l = range ep.getListeners() {
+		if l.sslPool != nil && !seen[l.sslPool] {
+			n += l.sslPool.GetInstanceCount()
+			seen[l.sslPool] = true
+		}
+	}
+	return n
+}
+
+func (ep *EP) countError(code ErrorCode) {
+	if code >= 0 && code < errorCodeCount {
+		atomic.AddUint64(&ep.metrics.errors[code], 1)
+	} else {
+		atomic.AddUint64(&ep.metrics.unknownErrors, 1)
+	}
+}
+
+func (ep *EP) countClose(reason CloseReason) {
+	atomic.AddUint64(&ep.metrics.closes[reason], 1)
+}
+
+func (ep *EP) countRead(n int) {
+	atomic.AddUint64(&ep.metrics.reads, 1)
+	atomic.AddUint64(&ep.metrics.bytesRead, uint64(n))
+}
+
+func (ep *EP) countWrite(n int) {
+	if n > 0 {
+		atomic.AddUint64(&ep.metrics.bytesWritten, uint64(n))
+	}
+}
+
+func (ep *EP) countEpollWait(n int) {
+	atomic.AddUint64(&ep.metrics.epollWaits, 1)
+	atomic.AddUint64(&ep.metrics.epollEvents, uint64(n))
+	var max uint64
+	for {
+		if max = atomic.LoadUint64(&ep.metrics.epollMaxBatch); uint64(n) <= max {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&ep.metrics.epollMaxBatch, max, uint64(n)) {
+			return
+		}
+	}
+}
+
+// counts the error and passes it to OnError if set
+func (ep *EP) reportError(sequenceId int, fd int, code ErrorCode, err error) {
+	ep.countError(code)
+	if ep.Callbacks.hasError() {
+		ep.InvokeError(sequenceId, fd, code, err)
+	}
+}
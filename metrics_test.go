@@ -0,0 +1,85 @@
+package epoll
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// the counters follow an echoed message and a close by the peer
+func TestStats(t *testing.T) {
+	var ep = newEchoEP(t)
+	var closed = make(chan struct{}, 1)
+	ep.OnClose = func(fd int) { closed <- struct{}{} }
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListener("127.0.0.1", 0, nil)
+	})
+
+	var c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(testTimeout))
+	echo(t, c, "hello")
+	if n := ep.Stats().Connections; n != 1 {
+		t.Fatalf("%d connections, want 1", n)
+	}
+	c.Close()
+	select {
+	case <-closed:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for OnClose")
+	}
+
+	var s = ep.Stats()
+	var tests = []struct {
+		name string
+		got  uint64
+		want uint64
+	}{
+		{"Accepts", s.Accepts, 1},
+		{"AcceptErrors", s.AcceptErrors, 0},
+		{"AcceptRejects", s.AcceptRejects, 0},
+		{"BytesRead", s.BytesRead, 5},
+		{"BytesWritten", s.BytesWritten, 5},
+		{"Closes[CLOSE_REASON_PEER]", s.Closes[CLOSE_REASON_PEER], 1},
+		{"Closes[CLOSE_REASON_ERROR]", s.Closes[CLOSE_REASON_ERROR], 0},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s %d, want %d", tt.name, tt.got, tt.want)
+		}
+	}
+	if s.Reads == 0 || s.ReadWakeups < s.Reads {
+		t.Errorf("%d reads in %d wakeups", s.Reads, s.ReadWakeups)
+	}
+	if s.EpollWaits == 0 || s.EpollEvents == 0 || s.EpollMaxBatch == 0 || s.EpollMaxBatch > s.EpollEvents {
+		t.Errorf("%d events in %d waits, at most %d at once", s.EpollEvents, s.EpollWaits, s.EpollMaxBatch)
+	}
+	if s.ConnPool.Gets == 0 || s.ConnPool.Hits+s.ConnPool.Misses+s.ConnPool.Failures != s.ConnPool.Gets {
+		t.Errorf("conn pool %+v", s.ConnPool)
+	}
+	if s.Connections != 0 {
+		t.Errorf("%d connections after the close", s.Connections)
+	}
+	if len(s.Closes) != closeReasonCount {
+		t.Errorf("%d close reasons, want %d", len(s.Closes), closeReasonCount)
+	}
+	if len(s.Errors) != 0 {
+		t.Errorf("errors %v", s.Errors)
+	}
+}
+
+// only codes that occurred are reported, codes out of range go to ERROR_UNKNOW
+func TestStatsErrors(t *testing.T) {
+	var ep = newTestEP(t)
+	ep.countError(ERROR_ACCEPT)
+	ep.countError(ERROR_ACCEPT)
+	ep.countError(ErrorCode(errorCodeCount))
+	ep.countError(ErrorCode(-1))
+
+	var errors = ep.Stats().Errors
+	if len(errors) != 2 || errors[ERROR_ACCEPT] != 2 || errors[ERROR_UNKNOW] != 2 {
+		t.Fatalf("errors %v, want 2 ERROR_ACCEPT and 2 ERROR_UNKNOW", errors)
+	}
+}
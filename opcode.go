@@ -9,4 +9,9 @@ const (
 	OP_EPOLLOUT OpCode = 3
 	OP_CLOSE    OpCode = 4
 	OP_ERROR    OpCode = 5
+	OP_CONNECT  OpCode = 6
+	OP_ACCEPTED OpCode = 7
+	OP_DRAIN    OpCode = 8
+	OP_IDLE     OpCode = 9
+	OP_SENDFILE OpCode = 10
 )
@@ -0,0 +1,201 @@
+//go:build cgo && !gotls
+// +build cgo,!gotls
+
+package epoll
+
+/*
+#cgo LDFLAGS: -lssl -lcrypto -ldl
+#ifdef __linux__
+#include <malloc.h>
+#elif __APPLE__
+#include <malloc/malloc.h>
+#else
+# error "Unknown compiler"
+#endif
+#include <stdint.h>
+#include <stdio.h>
+#include <string.h>
+#include <openssl/evp.h>
+#include <openssl/rand.h>
+#include <openssl/ssl.h>
+#include <openssl/dh.h>
+#include <openssl/err.h>
+#include <openssl/crypto.h>
+
+// the error queue is per thread, it is cleared before the call and read by SSL_get_error in the same call,
+// otherwise errors left by another connection on the thread turn a retry into SSL_ERROR_SSL
+static int ssl_accept(SSL *ssl, int *code) {
+	ERR_clear_error();
+	int ret = SSL_accept(ssl);
+	*code = SSL_get_error(ssl, ret);
+	return ret;
+}
+
+static int ssl_read(SSL *ssl, void *buf, int num, int *code) {
+	ERR_clear_error();
+	int ret = SSL_read(ssl, buf, num);
+	*code = SSL_get_error(ssl, ret);
+	return ret;
+}
+
+static int ssl_write(SSL *ssl, const void *buf, int num, int *code) {
+	ERR_clear_error();
+	int ret = SSL_write(ssl, buf, num);
+	*code = SSL_get_error(ssl, ret);
+	return ret;
+}
+*/
+import "C"
+import (
+	"fmt"
+	"runtime"
+	"time"
+	"unsafe"
+)
+
+// the OpenSSL backend, the default when cgo is available
+type sslCtx = C.SSL_CTX
+type sslHandle = C.SSL
+
+func newSSLCtx(certFile string, keyFile string, opts sslOptions) (*sslCtx, error) {
+	// the OpenSSL error queue is per thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	// var cret C.int = C.OPENSSL_init_ssl(C.OPENSSL_INIT_LOAD_SSL_STRINGS|C.OPENSSL_INIT_LOAD_CRYPTO_STRINGS, nil)
+	var cret C.int = C.OPENSSL_init_ssl(0, nil)
+	if cret <= 0 {
+		return nil, sslError(ErrorSSLInit, "")
+	}
+
+	var method = C.SSLv23_server_method()
+	var ctx = C.SSL_CTX_new(method)
+	if ctx == nil {
+		return nil, sslError(ErrorSSLContext, "")
+	}
+
+	C.SSL_CTX_ctrl(ctx, C.SSL_CTRL_MODE, C.SSL_MODE_AUTO_RETRY|C.SSL_MODE_ACCEPT_MOVING_WRITE_BUFFER, C.NULL)
+
+	var ccertp = C.CString(certFile)
+	var ckeyp = C.CString(keyFile)
+
+	defer C.free(unsafe.Pointer(ccertp))
+	defer C.free(unsafe.Pointer(ckeyp))
+
+	if C.SSL_CTX_use_certificate_file(ctx, ccertp, C.SSL_FILETYPE_PEM) <= 0 {
+		C.SSL_CTX_free(ctx)
+		return nil, sslError(ErrorSSLCertificate, certFile)
+	}
+
+	if C.SSL_CTX_use_PrivateKey_file(ctx, ckeyp, C.SSL_FILETYPE_PEM) <= 0 {
+		C.SSL_CTX_free(ctx)
+		return nil, sslError(ErrorSSLPrivateKey, keyFile)
+	}
+
+	if C.SSL_CTX_check_private_key(ctx) <= 0 {
+		C.SSL_CTX_free(ctx)
+		return nil, sslError(ErrorSSLPrivateKey, keyFile)
+	}
+
+	if err := setSSLVerify(ctx, opts.verify); err != nil {
+		C.SSL_CTX_free(ctx)
+		return nil, err
+	}
+
+	if err := setSSLConfig(ctx, opts.config, opts.tickets); err != nil {
+		C.SSL_CTX_free(ctx)
+		return nil, err
+	}
+
+	setALPN(ctx, opts.alpn)
+
+	setKTLS(ctx, opts.ktls)
+
+	return ctx, nil
+}
+
+// adds the file and the reason queued by OpenSSL, errors.Is(err, base) still holds
+func sslError(base error, file string) error {
+	var reason string
+	var code = C.ERR_get_error()
+	if code != 0 {
+		var buf [256]C.char
+		C.ERR_error_string_n(code, &buf[0], C.size_t(len(buf)))
+		reason = C.GoString(&buf[0])
+	}
+	C.ERR_clear_error()
+	if file != "" {
+		base = fmt.Errorf("%w %s", base, file)
+	}
+	if reason != "" {
+		return fmt.Errorf("%w: %s", base, reason)
+	}
+	return base
+}
+
+func freeSSLCtx(ctx *sslCtx) {
+	if ctx != nil {
+		C.SSL_CTX_free(ctx)
+	}
+}
+
+func newSSLHandle(ctx *sslCtx) *sslHandle {
+	return C.SSL_new(ctx)
+}
+
+func freeSSLHandle(ssl *sslHandle) {
+	C.SSL_free(ssl)
+}
+
+// prepares ssl to accept a new connection on fd
+func setSSLFd(ssl *sslHandle, fd int) bool {
+	if C.SSL_set_fd(ssl, (C.int)(fd)) <= 0 {
+		return false
+	}
+	C.SSL_set_accept_state(ssl)
+	return true
+}
+
+func clearSSLHandle(ssl *sslHandle) {
+	// SSL_clear drops the session from the cache unless the connection looks shut down cleanly,
+	// sessions of failed connections were already dropped when the fatal alert was sent
+	C.SSL_set_shutdown(ssl, C.SSL_SENT_SHUTDOWN|C.SSL_RECEIVED_SHUTDOWN)
+	C.SSL_clear(ssl)
+}
+
+func GetSSLErrorNumber(ssl *sslHandle, ret int) int {
+	return int(C.SSL_get_error(ssl, (C.int)(ret)))
+}
+
+func sslAccept(ssl *sslHandle) (int, int) {
+	var code C.int
+	var ret = int(C.ssl_accept(ssl, &code))
+	return ret, int(code)
+}
+
+func sslRead(ssl *sslHandle, buffer []byte, n int) (int, int) {
+	var code C.int
+	var ret = int(C.ssl_read(ssl, unsafe.Pointer(&buffer[0]), (C.int)(n), &code))
+	return ret, int(code)
+}
+
+func sslWrite(ssl *sslHandle, buffer []byte, n int) (int, int) {
+	var code C.int
+	var ret = int(C.ssl_write(ssl, unsafe.Pointer(&buffer[0]), (C.int)(n), &code))
+	return ret, int(code)
+}
+
+func cMallocTrim() {
+	C.malloc_trim(0)
+}
+
+func cMallocTrimLoop() {
+	go func() {
+		var timer = time.NewTicker(DEFAULT_C_MALLOC_TRIM_INTERVAL * time.Second)
+		defer timer.Stop()
+		for {
+			<-timer.C
+			cMallocTrim()
+		}
+	}()
+}
@@ -0,0 +1,85 @@
+//go:build cgo && !gotls
+// +build cgo,!gotls
+
+package epoll
+
+/*
+#include <stdlib.h>
+#include <string.h>
+#include <openssl/ssl.h>
+
+typedef struct {
+	unsigned char *protos;
+	unsigned int len;
+} alpn_protos;
+
+static int alpn_index = -1;
+
+static void alpn_free_cb(void *parent, void *ptr, CRYPTO_EX_DATA *ad, int idx, long argl, void *argp) {
+	alpn_protos *p = (alpn_protos *)ptr;
+	if (p != NULL) {
+		free(p->protos);
+		free(p);
+	}
+}
+
+static void alpn_init(void) {
+	alpn_index = SSL_CTX_get_ex_new_index(0, NULL, NULL, NULL, alpn_free_cb);
+}
+
+// the first protocol of the server list the client also offers, no ALPN when there is none
+static int alpn_select_cb(SSL *ssl, const unsigned char **out, unsigned char *outlen, const unsigned char *in, unsigned int inlen, void *arg) {
+	alpn_protos *p = (alpn_protos *)arg;
+	if (SSL_select_next_proto((unsigned char **)out, outlen, p->protos, p->len, in, inlen) != OPENSSL_NPN_NEGOTIATED) {
+		return SSL_TLSEXT_ERR_NOACK;
+	}
+	return SSL_TLSEXT_ERR_OK;
+}
+
+// protos is copied and freed with ctx
+static void alpn_set(SSL_CTX *ctx, const unsigned char *protos, unsigned int len) {
+	alpn_protos *p = malloc(sizeof(alpn_protos));
+	p->protos = malloc(len);
+	memcpy(p->protos, protos, len);
+	p->len = len;
+	SSL_CTX_set_ex_data(ctx, alpn_index, p);
+	SSL_CTX_set_alpn_select_cb(ctx, alpn_select_cb, p);
+}
+
+static void alpn_selected(SSL *ssl, const unsigned char **data, unsigned int *len) {
+	SSL_get0_alpn_selected(ssl, data, len);
+}
+*/
+import "C"
+import (
+	"sync"
+	"unsafe"
+)
+
+var alpnOnce sync.Once
+
+func setALPN(ctx *sslCtx, protocols []string) {
+	if len(protocols) == 0 {
+		return
+	}
+	var wire []byte
+	var p string
+	for _, p = range protocols {
+		wire = append(wire, byte(len(p)))
+		wire = append(wire, p...)
+	}
+	alpnOnce.Do(func() {
+		C.alpn_init()
+	})
+	C.alpn_set(ctx, (*C.uchar)(unsafe.Pointer(&wire[0])), C.uint(len(wire)))
+}
+
+func sslSelectedProtocol(ssl *sslHandle) string {
+	var data *C.uchar
+	var n C.uint
+	C.alpn_selected(ssl, &data, &n)
+	if data == nil || n == 0 {
+		return ""
+	}
+	return C.GoStringN((*C.char)(unsafe.Pointer(data)), C.int(n))
+}
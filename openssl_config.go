@@ -0,0 +1,262 @@
+//go:build cgo && !gotls
+// +build cgo,!gotls
+
+package epoll
+
+/*
+#include <stdlib.h>
+#include <string.h>
+#include <pthread.h>
+#include <openssl/ssl.h>
+#include <openssl/rand.h>
+#include <openssl/evp.h>
+#include <openssl/hmac.h>
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+#include <openssl/core_names.h>
+#endif
+
+// OpenSSL takes min above max and then fails every handshake, rejected like crypto/tls does
+static int ssl_set_versions(SSL_CTX *ctx, int min, int max) {
+	if (min > 0 && max > 0 && min > max) {
+		return 0;
+	}
+	if (min > 0 && SSL_CTX_set_min_proto_version(ctx, min) <= 0) {
+		return 0;
+	}
+	if (max > 0 && SSL_CTX_set_max_proto_version(ctx, max) <= 0) {
+		return 0;
+	}
+	return 1;
+}
+
+static int ssl_set_groups(SSL_CTX *ctx, const char *groups) {
+	return SSL_CTX_set1_groups_list(ctx, groups);
+}
+
+static void ssl_set_options(SSL_CTX *ctx, unsigned long options) {
+	SSL_CTX_set_options(ctx, options);
+}
+
+static void ssl_set_session_cache(SSL_CTX *ctx, long size, long mode) {
+	SSL_CTX_set_session_cache_mode(ctx, mode);
+	if (size > 0) {
+		SSL_CTX_sess_set_cache_size(ctx, size);
+	}
+}
+
+// session ticket keys shared by every context of an EP, keys[0] encrypts, keys[1] is the previous key
+// a key is the name (16 bytes), the AES key (32) and the HMAC key (32)
+typedef struct {
+	pthread_mutex_t lock;
+	int refs;
+	int count;
+	unsigned char keys[2][80];
+} ticket_ring;
+
+static int ticket_index = -1;
+
+static ticket_ring *ticket_ring_new(void) {
+	ticket_ring *r = calloc(1, sizeof(ticket_ring));
+	pthread_mutex_init(&r->lock, NULL);
+	r->refs = 1;
+	return r;
+}
+
+static void ticket_ring_release(ticket_ring *r) {
+	int refs;
+	pthread_mutex_lock(&r->lock);
+	refs = --r->refs;
+	pthread_mutex_unlock(&r->lock);
+	if (refs == 0) {
+		OPENSSL_cleanse(r->keys, sizeof(r->keys));
+		pthread_mutex_destroy(&r->lock);
+		free(r);
+	}
+}
+
+static int ticket_ring_rotate(ticket_ring *r) {
+	unsigned char key[80];
+	if (RAND_bytes(key, sizeof(key)) <= 0) {
+		return 0;
+	}
+	pthread_mutex_lock(&r->lock);
+	memcpy(r->keys[1], r->keys[0], sizeof(key));
+	memcpy(r->keys[0], key, sizeof(key));
+	if (r->count < 2) {
+		r->count++;
+	}
+	pthread_mutex_unlock(&r->lock);
+	OPENSSL_cleanse(key, sizeof(key));
+	return 1;
+}
+
+static void ticket_free_cb(void *parent, void *ptr, CRYPTO_EX_DATA *ad, int idx, long argl, void *argp) {
+	if (ptr != NULL) {
+		ticket_ring_release((ticket_ring *)ptr);
+	}
+}
+
+static void ticket_init(void) {
+	ticket_index = SSL_CTX_get_ex_new_index(0, NULL, NULL, NULL, ticket_free_cb);
+}
+
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+typedef EVP_MAC_CTX ticket_hmac_ctx;
+
+static int ticket_hmac_init(EVP_MAC_CTX *hctx, unsigned char *key) {
+	OSSL_PARAM params[3];
+	params[0] = OSSL_PARAM_construct_octet_string(OSSL_MAC_PARAM_KEY, key, 32);
+	params[1] = OSSL_PARAM_construct_utf8_string(OSSL_MAC_PARAM_DIGEST, "SHA256", 0);
+	params[2] = OSSL_PARAM_construct_end();
+	return EVP_MAC_CTX_set_params(hctx, params);
+}
+#else
+typedef HMAC_CTX ticket_hmac_ctx;
+
+static int ticket_hmac_init(HMAC_CTX *hctx, unsigned char *key) {
+	return HMAC_Init_ex(hctx, key, 32, EVP_sha256(), NULL);
+}
+#endif
+
+// returns 2 for tickets of the previous key, so the client gets a new one
+static int ticket_key_cb(SSL *ssl, unsigned char *name, unsigned char *iv, EVP_CIPHER_CTX *ectx, ticket_hmac_ctx *hctx, int enc) {
+	ticket_ring *r = SSL_CTX_get_ex_data(SSL_get_SSL_CTX(ssl), ticket_index);
+	unsigned char key[80];
+	int i, found = -1, ret = -1;
+	if (r == NULL) {
+		return -1;
+	}
+	pthread_mutex_lock(&r->lock);
+	for (i = 0; i < r->count; i++) {
+		if (enc || memcmp(name, r->keys[i], 16) == 0) {
+			memcpy(key, r->keys[i], sizeof(key));
+			found = i;
+			break;
+		}
+	}
+	pthread_mutex_unlock(&r->lock);
+	if (found < 0) {
+		return enc ? -1 : 0;
+	}
+	if (enc) {
+		memcpy(name, key, 16);
+		if (RAND_bytes(iv, EVP_CIPHER_iv_length(EVP_aes_256_cbc())) > 0
+			&& EVP_EncryptInit_ex(ectx, EVP_aes_256_cbc(), NULL, key + 16, iv) > 0
+			&& ticket_hmac_init(hctx, key + 48) > 0) {
+			ret = 1;
+		}
+	} else if (EVP_DecryptInit_ex(ectx, EVP_aes_256_cbc(), NULL, key + 16, iv) > 0
+		&& ticket_hmac_init(hctx, key + 48) > 0) {
+		ret = found == 0 ? 1 : 2;
+	}
+	OPENSSL_cleanse(key, sizeof(key));
+	return ret;
+}
+
+static void ticket_ring_attach(SSL_CTX *ctx, ticket_ring *r) {
+	pthread_mutex_lock(&r->lock);
+	r->refs++;
+	pthread_mutex_unlock(&r->lock);
+	SSL_CTX_set_ex_data(ctx, ticket_index, r);
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+	SSL_CTX_set_tlsext_ticket_key_evp_cb(ctx, ticket_key_cb);
+#else
+	SSL_CTX_set_tlsext_ticket_key_cb(ctx, ticket_key_cb);
+#endif
+}
+*/
+import "C"
+import (
+	"sync"
+	"unsafe"
+)
+
+var ticketOnce sync.Once
+
+// keys used for session tickets by every context of the EP, so tickets survive SNI switches and ReloadCertificates
+type sessionTickets struct {
+	ring *C.ticket_ring
+}
+
+func newSessionTickets() (*sessionTickets, error) {
+	ticketOnce.Do(func() {
+		C.ticket_init()
+	})
+	var t = &sessionTickets{ring: C.ticket_ring_new()}
+	if err := t.rotate(); err != nil {
+		t.release()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *sessionTickets) rotate() error {
+	if C.ticket_ring_rotate(t.ring) <= 0 {
+		return sslError(ErrorSSLConfig, "TicketKeyRotation")
+	}
+	return nil
+}
+
+// contexts using the keys hold their own reference
+func (t *sessionTickets) release() {
+	C.ticket_ring_release(t.ring)
+}
+
+func setSSLConfig(ctx *sslCtx, c *SSLConfig, tickets *sessionTickets) error {
+	if c == nil {
+		return nil
+	}
+
+	if C.ssl_set_versions(ctx, C.int(c.MinVersion), C.int(c.MaxVersion)) <= 0 {
+		return sslError(ErrorSSLConfig, "MinVersion/MaxVersion")
+	}
+
+	if c.Ciphers != "" {
+		var s = C.CString(c.Ciphers)
+		defer C.free(unsafe.Pointer(s))
+		if C.SSL_CTX_set_cipher_list(ctx, s) <= 0 {
+			return sslError(ErrorSSLConfig, "Ciphers "+c.Ciphers)
+		}
+	}
+
+	if c.CipherSuites != "" {
+		var s = C.CString(c.CipherSuites)
+		defer C.free(unsafe.Pointer(s))
+		if C.SSL_CTX_set_ciphersuites(ctx, s) <= 0 {
+			return sslError(ErrorSSLConfig, "CipherSuites "+c.CipherSuites)
+		}
+	}
+
+	if c.Groups != "" {
+		var s = C.CString(c.Groups)
+		defer C.free(unsafe.Pointer(s))
+		if C.ssl_set_groups(ctx, s) <= 0 {
+			return sslError(ErrorSSLConfig, "Groups "+c.Groups)
+		}
+	}
+
+	var options C.ulong
+	if c.PreferServerCiphers {
+		options |= C.SSL_OP_CIPHER_SERVER_PREFERENCE
+	}
+	if c.DisableSessionTickets {
+		options |= C.SSL_OP_NO_TICKET
+	}
+	if options != 0 {
+		C.ssl_set_options(ctx, options)
+	}
+
+	if c.SessionCacheSize < 0 {
+		C.ssl_set_session_cache(ctx, 0, C.SSL_SESS_CACHE_OFF)
+	} else {
+		C.ssl_set_session_cache(ctx, C.long(c.SessionCacheSize), C.SSL_SESS_CACHE_SERVER)
+	}
+	if c.SessionTimeout > 0 {
+		C.SSL_CTX_set_timeout(ctx, C.long(c.SessionTimeout))
+	}
+
+	if tickets != nil && !c.DisableSessionTickets {
+		C.ticket_ring_attach(ctx, tickets.ring)
+	}
+	return nil
+}
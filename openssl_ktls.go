@@ -0,0 +1,45 @@
+//go:build cgo && !gotls
+// +build cgo,!gotls
+
+package epoll
+
+/*
+#include <openssl/ssl.h>
+#include <openssl/bio.h>
+
+static void ktls_enable(SSL_CTX *ctx) {
+#ifdef SSL_OP_ENABLE_KTLS
+	SSL_CTX_set_options(ctx, SSL_OP_ENABLE_KTLS);
+#endif
+}
+
+// the BIO kTLS controls exist from OpenSSL 3.0, unless it was built without kTLS
+static int ktls_send(SSL *ssl) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L && !defined(OPENSSL_NO_KTLS)
+	return BIO_get_ktls_send(SSL_get_wbio(ssl));
+#else
+	return 0;
+#endif
+}
+
+// records OpenSSL has already read stay with SSL_read
+static int ktls_recv(SSL *ssl) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L && !defined(OPENSSL_NO_KTLS)
+	return BIO_get_ktls_recv(SSL_get_rbio(ssl)) && !SSL_has_pending(ssl);
+#else
+	return 0;
+#endif
+}
+*/
+import "C"
+
+// OpenSSL sets up the kernel when the keys change and carries on in user space if that fails
+func setKTLS(ctx *sslCtx, enabled bool) {
+	if enabled {
+		C.ktls_enable(ctx)
+	}
+}
+
+func sslKTLS(ssl *sslHandle) (bool, bool) {
+	return C.ktls_send(ssl) != 0, C.ktls_recv(ssl) != 0
+}
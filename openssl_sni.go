@@ -0,0 +1,175 @@
+//go:build cgo && !gotls
+// +build cgo,!gotls
+
+package epoll
+
+/*
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <openssl/ssl.h>
+
+typedef struct {
+	SSL_CTX *owner;
+	int count;
+	char **names;
+	SSL_CTX **ctxs;
+} sni_store;
+
+static int sni_index = -1;
+
+static sni_store *sni_store_new(SSL_CTX *owner, int capacity) {
+	sni_store *s = calloc(1, sizeof(sni_store));
+	s->owner = owner;
+	s->names = calloc(capacity, sizeof(char *));
+	s->ctxs = calloc(capacity, sizeof(SSL_CTX *));
+	return s;
+}
+
+// the store keeps its own reference to ctx, except to its owner
+static void sni_store_add(sni_store *s, const char *name, SSL_CTX *ctx) {
+	if (ctx != s->owner) {
+		SSL_CTX_up_ref(ctx);
+	}
+	s->names[s->count] = strdup(name);
+	s->ctxs[s->count] = ctx;
+	s->count++;
+}
+
+static void sni_store_free(sni_store *s) {
+	int i;
+	for (i = 0; i < s->count; i++) {
+		free(s->names[i]);
+		if (s->ctxs[i] != s->owner) {
+			SSL_CTX_free(s->ctxs[i]);
+		}
+	}
+	free(s->names);
+	free(s->ctxs);
+	free(s);
+}
+
+static void sni_store_free_cb(void *parent, void *ptr, CRYPTO_EX_DATA *ad, int idx, long argl, void *argp) {
+	if (ptr != NULL) {
+		sni_store_free((sni_store *)ptr);
+	}
+}
+
+static void sni_init(void) {
+	sni_index = SSL_CTX_get_ex_new_index(0, NULL, NULL, NULL, sni_store_free_cb);
+}
+
+// exact names first, then "*.example.com" for one label in front of example.com
+static SSL_CTX *sni_lookup(sni_store *s, const char *name) {
+	int i;
+	const char *dot = strchr(name, '.');
+	for (i = 0; i < s->count; i++) {
+		if (strcasecmp(s->names[i], name) == 0) {
+			return s->ctxs[i];
+		}
+	}
+	if (dot == NULL || dot == name) {
+		return NULL;
+	}
+	for (i = 0; i < s->count; i++) {
+		if (s->names[i][0] == '*' && strcasecmp(s->names[i] + 1, dot) == 0) {
+			return s->ctxs[i];
+		}
+	}
+	return NULL;
+}
+
+static int sni_servername_cb(SSL *ssl, int *al, void *arg) {
+	const char *name = SSL_get_servername(ssl, TLSEXT_NAMETYPE_host_name);
+	SSL_CTX *ctx;
+	if (name == NULL) {
+		return SSL_TLSEXT_ERR_NOACK;
+	}
+	ctx = sni_lookup((sni_store *)arg, name);
+	if (ctx != NULL && ctx != SSL_get_SSL_CTX(ssl)) {
+		SSL_set_SSL_CTX(ssl, ctx);
+	}
+	return SSL_TLSEXT_ERR_OK;
+}
+
+// the store is kept as ex data and freed with ctx, which may outlive freeSSLCtx while SSL objects still use it
+static void sni_store_attach(SSL_CTX *ctx, sni_store *s) {
+	SSL_CTX_set_ex_data(ctx, sni_index, s);
+	SSL_CTX_set_tlsext_servername_callback(ctx, sni_servername_cb);
+	SSL_CTX_set_tlsext_servername_arg(ctx, s);
+}
+
+static const char *sni_servername(SSL *ssl) {
+	return SSL_get_servername(ssl, TLSEXT_NAMETYPE_host_name);
+}
+*/
+import "C"
+import (
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+var sniOnce sync.Once
+
+// the context of the default certificate, which switches to the context of the matching name during the handshake
+// certificates used for several names are loaded once
+func newSNISSLCtx(certs *SSLCertificates, opts sslOptions) (*sslCtx, error) {
+	var ctx, err = newSSLCtx(certs.Default.CertFile, certs.Default.KeyFile, opts)
+	if err != nil || len(certs.Names) == 0 {
+		return ctx, err
+	}
+
+	var loaded = map[SSLCertificate]*sslCtx{}
+	var release = func() {
+		var c *sslCtx
+		for _, c = range loaded {
+			C.SSL_CTX_free(c)
+		}
+	}
+
+	sniOnce.Do(func() {
+		C.sni_init()
+	})
+	var store = C.sni_store_new(ctx, C.int(len(certs.Names)))
+	C.sni_store_attach(ctx, store)
+
+	var name string
+	var cert SSLCertificate
+	var c *sslCtx
+	var ok bool
+	for name, cert = range certs.Names {
+		if cert == certs.Default {
+			c = ctx
+		} else if c, ok = loaded[cert]; !ok {
+			if c, err = newSSLCtx(cert.CertFile, cert.KeyFile, opts); err != nil {
+				release()
+				freeSSLCtx(ctx)
+				return nil, err
+			}
+			loaded[cert] = c
+		}
+		var cname = C.CString(strings.TrimSuffix(name, "."))
+		C.sni_store_add(store, cname, c)
+		C.free(unsafe.Pointer(cname))
+	}
+
+	// the store holds its own references now
+	release()
+	return ctx, nil
+}
+
+// pooled SSL objects keep the context the previous handshake switched to
+func resetSSLCtx(ssl *sslHandle, ctx *sslCtx) {
+	if C.SSL_get_SSL_CTX(ssl) != ctx {
+		C.SSL_set_SSL_CTX(ssl, ctx)
+	}
+}
+
+func sslServerName(ssl *sslHandle) string {
+	var name = C.sni_servername(ssl)
+	if name == nil {
+		return ""
+	}
+	return C.GoString(name)
+}
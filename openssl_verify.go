@@ -0,0 +1,130 @@
+//go:build cgo && !gotls
+// +build cgo,!gotls
+
+package epoll
+
+/*
+#include <stdlib.h>
+#include <openssl/ssl.h>
+#include <openssl/x509.h>
+#include <openssl/x509_vfy.h>
+
+static int ssl_load_crl(SSL_CTX *ctx, const char *file, unsigned long flags) {
+	X509_STORE *store = SSL_CTX_get_cert_store(ctx);
+	X509_LOOKUP *lookup = X509_STORE_add_lookup(store, X509_LOOKUP_file());
+	if (lookup == NULL || X509_load_crl_file(lookup, file, X509_FILETYPE_PEM) <= 0) {
+		return 0;
+	}
+	return X509_STORE_set_flags(store, flags);
+}
+
+static X509 *ssl_peer_certificate(SSL *ssl) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+	return SSL_get1_peer_certificate(ssl);
+#else
+	return SSL_get_peer_certificate(ssl);
+#endif
+}
+
+// on the server side the chain does not include the peer certificate itself
+static int ssl_peer_chain_len(SSL *ssl) {
+	STACK_OF(X509) *chain = SSL_get_peer_cert_chain(ssl);
+	return chain == NULL ? 0 : sk_X509_num(chain);
+}
+
+static X509 *ssl_peer_chain_at(SSL *ssl, int i) {
+	return sk_X509_value(SSL_get_peer_cert_chain(ssl), i);
+}
+
+static int x509_der(X509 *x, unsigned char **out) {
+	*out = NULL;
+	return i2d_X509(x, out);
+}
+
+static void openssl_free(void *p) {
+	OPENSSL_free(p);
+}
+*/
+import "C"
+import "unsafe"
+
+func setSSLVerify(ctx *sslCtx, v *SSLVerify) error {
+	if v == nil || v.Mode == SSL_VERIFY_NONE {
+		return nil
+	}
+	if err := checkSSLVerify(v); err != nil {
+		return err
+	}
+
+	var cafile, capath *C.char
+	if v.CAFile != "" {
+		cafile = C.CString(v.CAFile)
+		defer C.free(unsafe.Pointer(cafile))
+	}
+	if v.CAPath != "" {
+		capath = C.CString(v.CAPath)
+		defer C.free(unsafe.Pointer(capath))
+	}
+	if C.SSL_CTX_load_verify_locations(ctx, cafile, capath) <= 0 {
+		return sslError(ErrorSSLCA, v.CAFile+v.CAPath)
+	}
+	// tells the client which CAs are accepted
+	if cafile != nil {
+		if names := C.SSL_load_client_CA_file(cafile); names != nil {
+			C.SSL_CTX_set_client_CA_list(ctx, names)
+		}
+	}
+
+	if v.CRLFile != "" {
+		var flags C.ulong = C.X509_V_FLAG_CRL_CHECK
+		if v.CRLCheckAll {
+			flags |= C.X509_V_FLAG_CRL_CHECK_ALL
+		}
+		var crlfile = C.CString(v.CRLFile)
+		defer C.free(unsafe.Pointer(crlfile))
+		if C.ssl_load_crl(ctx, crlfile, flags) <= 0 {
+			return sslError(ErrorSSLCRL, v.CRLFile)
+		}
+	}
+
+	var mode C.int = C.SSL_VERIFY_PEER
+	if v.Mode == SSL_VERIFY_REQUIRED {
+		mode |= C.SSL_VERIFY_FAIL_IF_NO_PEER_CERT
+	}
+	C.SSL_CTX_set_verify(ctx, mode, nil)
+	if v.Depth > 0 {
+		C.SSL_CTX_set_verify_depth(ctx, C.int(v.Depth))
+	}
+
+	// resumed sessions fail without it once client certificates are requested
+	var sid = []byte("gotcp/epoll")
+	C.SSL_CTX_set_session_id_context(ctx, (*C.uchar)(unsafe.Pointer(&sid[0])), C.uint(len(sid)))
+	return nil
+}
+
+// DER of the client certificate followed by the chain it sent, nil without a client certificate
+func sslPeerChain(ssl *sslHandle) [][]byte {
+	var leaf = C.ssl_peer_certificate(ssl)
+	if leaf == nil {
+		return nil
+	}
+	var chain = [][]byte{x509DER(leaf)}
+	C.X509_free(leaf)
+
+	var i int
+	var n = int(C.ssl_peer_chain_len(ssl))
+	for i = 0; i < n; i++ {
+		chain = append(chain, x509DER(C.ssl_peer_chain_at(ssl, C.int(i))))
+	}
+	return chain
+}
+
+func x509DER(x *C.X509) []byte {
+	var out *C.uchar
+	var n = C.x509_der(x, &out)
+	if n <= 0 {
+		return nil
+	}
+	defer C.openssl_free(unsafe.Pointer(out))
+	return C.GoBytes(unsafe.Pointer(out), n)
+}
@@ -9,6 +9,7 @@ func bufferRecycleUpdate(ptr interface{}) {
 
 func (ep *EP) GetBuffer() (*[]byte, error) {
 	var iface, err = ep.bufferPool.Get()
+	ep.metrics.bufferPool.get(err)
 	if err == nil {
 		var buffer, ok = iface.(*[]byte)
 		if ok {
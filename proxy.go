@@ -0,0 +1,284 @@
+package epoll
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	PROXY_V1_MAX_LENGTH = 107
+	PROXY_V2_HEADER     = 16
+)
+
+const (
+	PROXY_TLV_ALPN      = 0x01
+	PROXY_TLV_AUTHORITY = 0x02
+	PROXY_TLV_CRC32C    = 0x03
+	PROXY_TLV_NOOP      = 0x04
+	PROXY_TLV_UNIQUE_ID = 0x05
+	PROXY_TLV_SSL       = 0x20
+	PROXY_TLV_NETNS     = 0x30
+)
+
+var proxyV1Prefix = []byte("PROXY ")
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+type proxyHeader struct {
+	src  net.Addr // nil for LOCAL and UNKNOWN, the connection keeps its own addresses
+	dst  net.Addr
+	tlvs []ProxyTLV
+}
+
+// listeners added afterwards expect a PROXY protocol v1 or v2 header before any data,
+// including the TLS handshake, malformed headers close the connection with ERROR_PROXY_PROTOCOL
+// the IP filter and the per-IP limit run on accept, before the header is read,
+// so they apply to the address of the proxy, not to the client address the header carries
+func (ep *EP) SetProxyProtocol(enabled bool) {
+	ep.ProxyProtocol = enabled
+}
+
+// the TLVs of the PROXY v2 header of the connection
+func (ep *EP) GetConnectionProxyTLVs(fd int) []ProxyTLV {
+	var tlvs []ProxyTLV
+	ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+		var c, ok = value.(*Conn)
+		if ok {
+			tlvs = c.ProxyTLVs
+		}
+	})
+	return tlvs
+}
+
+// runs on the event loop, the header is peeked until it is complete and only then consumed,
+// so nothing after it is taken away from the TLS handshake or OnReceive
+func (ep *EP) readProxyHeader(fd int, conn *Conn) (bool, bool) {
+	conn.outLock.Lock()
+	var generation = conn.Generation
+	conn.outLock.Unlock()
+	var buf = make([]byte, PROXY_V2_HEADER+216)
+	for {
+		var n, _, err = unix.Recvfrom(fd, buf, unix.MSG_PEEK)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
+				return false, true
+			}
+			ep.dropConnection(fd, conn, CLOSE_REASON_ERROR, ERROR_READ, err)
+			return false, false
+		}
+		if n == 0 {
+			ep.dropConnection(fd, conn, CLOSE_REASON_PEER, ERROR_UNKNOW, nil)
+			return false, false
+		}
+
+		var h *proxyHeader
+		var size int
+		if h, size, err = parseProxyHeader(buf[:n]); err != nil {
+			ep.dropConnection(fd, conn, CLOSE_REASON_PROXY, ERROR_PROXY_PROTOCOL, err)
+			return false, false
+		}
+		if size > len(buf) {
+			buf = make([]byte, size)
+			continue
+		}
+		if size == 0 || size > n {
+			return false, true
+		}
+
+		if _, err = unix.Read(fd, buf[:size]); err != nil {
+			ep.dropConnection(fd, conn, CLOSE_REASON_ERROR, ERROR_READ, err)
+			return false, false
+		}
+		var family = unix.AF_UNIX
+		if addr, ok := h.src.(*net.TCPAddr); ok && addr.IP.To4() == nil {
+			family = unix.AF_INET6
+		} else if ok {
+			family = unix.AF_INET
+		}
+		// the getters read these under the map lock
+		var found bool
+		ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+			var c, ok = value.(*Conn)
+			if found = ok && c == conn && c.Generation == generation; !found {
+				return
+			}
+			c.proxy = false
+			if h.src != nil {
+				c.RemoteAddr = h.src
+				c.LocalAddr = h.dst
+				c.Family = family
+			}
+			c.ProxyTLVs = h.tlvs
+		})
+		if !found {
+			return false, false
+		}
+		if conn.SSL != nil {
+			return true, true
+		}
+		if conn.hsTimer != nil {
+			conn.hsTimer.Stop()
+		}
+		if !atomic.CompareAndSwapInt32(&conn.handshake, HANDSHAKE_WANT_READ, HANDSHAKE_NONE) {
+			ep.dropConnection(fd, conn, CLOSE_REASON_PROXY, ERROR_PROXY_PROTOCOL, ErrorProxyHeaderTimeout)
+			return false, false
+		}
+		if ep.getCallbacks(conn.callbacks).hasAccept() {
+			ep.invoke(conn.SequenceId, ep.getRequestItemForAccepted(conn, conn.SequenceId, fd))
+		}
+		return true, true
+	}
+}
+
+// returns the header and its total size, the size is 0 while the start of buf is too short to tell,
+// and may exceed len(buf) when the v2 header is longer than what has been read
+func parseProxyHeader(buf []byte) (*proxyHeader, int, error) {
+	if len(buf) < len(proxyV2Signature) {
+		if bytes.HasPrefix(proxyV2Signature, buf) || bytes.HasPrefix(proxyV1Prefix, buf) || bytes.HasPrefix(buf, proxyV1Prefix) {
+			if bytes.HasPrefix(buf, proxyV1Prefix) {
+				return parseProxyV1(buf)
+			}
+			return nil, 0, nil
+		}
+		return nil, 0, ErrorProxyHeader
+	}
+	if bytes.HasPrefix(buf, proxyV2Signature) {
+		return parseProxyV2(buf)
+	}
+	if bytes.HasPrefix(buf, proxyV1Prefix) {
+		return parseProxyV1(buf)
+	}
+	return nil, 0, ErrorProxyHeader
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func parseProxyV1(buf []byte) (*proxyHeader, int, error) {
+	var end = bytes.Index(buf, []byte("\r\n"))
+	if end < 0 {
+		if len(buf) >= PROXY_V1_MAX_LENGTH {
+			return nil, 0, ErrorProxyHeader
+		}
+		return nil, 0, nil
+	}
+	if end+2 > PROXY_V1_MAX_LENGTH {
+		return nil, 0, ErrorProxyHeader
+	}
+
+	var fields = strings.Split(string(buf[:end]), " ")
+	if len(fields) < 2 {
+		return nil, 0, ErrorProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return &proxyHeader{}, end + 2, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, 0, ErrorProxyHeader
+	}
+
+	var src, dst = net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	if src == nil || dst == nil || (src.To4() != nil) != (fields[1] == "TCP4") || (dst.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, 0, ErrorProxyHeader
+	}
+	var srcPort, err1 = parseProxyPort(fields[4])
+	var dstPort, err2 = parseProxyPort(fields[5])
+	if err1 != nil || err2 != nil {
+		return nil, 0, ErrorProxyHeader
+	}
+
+	return &proxyHeader{
+		src: &net.TCPAddr{IP: src, Port: srcPort},
+		dst: &net.TCPAddr{IP: dst, Port: dstPort},
+	}, end + 2, nil
+}
+
+func parseProxyPort(s string) (int, error) {
+	if len(s) == 0 || (len(s) > 1 && s[0] == '0') {
+		return 0, ErrorProxyHeader
+	}
+	var port, err = strconv.ParseUint(s, 10, 16)
+	return int(port), err
+}
+
+func parseProxyV2(buf []byte) (*proxyHeader, int, error) {
+	if len(buf) < PROXY_V2_HEADER {
+		return nil, 0, nil
+	}
+	var version, command = buf[12] >> 4, buf[12] & 0x0f
+	if version != 2 || command > 1 {
+		return nil, 0, ErrorProxyHeader
+	}
+	var family, protocol = buf[13] >> 4, buf[13] & 0x0f
+	var size = PROXY_V2_HEADER + int(binary.BigEndian.Uint16(buf[14:16]))
+	if len(buf) < size {
+		return nil, size, nil
+	}
+
+	var body = buf[PROXY_V2_HEADER:size]
+	var h = &proxyHeader{}
+	var addrLen int
+	switch family {
+	case 0x0:
+		addrLen = 0
+	case 0x1:
+		addrLen = 12
+		if len(body) < addrLen {
+			return nil, 0, ErrorProxyHeader
+		}
+		h.src = &net.TCPAddr{IP: net.IP(append([]byte(nil), body[0:4]...)), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+		h.dst = &net.TCPAddr{IP: net.IP(append([]byte(nil), body[4:8]...)), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+	case 0x2:
+		addrLen = 36
+		if len(body) < addrLen {
+			return nil, 0, ErrorProxyHeader
+		}
+		h.src = &net.TCPAddr{IP: net.IP(append([]byte(nil), body[0:16]...)), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+		h.dst = &net.TCPAddr{IP: net.IP(append([]byte(nil), body[16:32]...)), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+	case 0x3:
+		addrLen = 216
+		if len(body) < addrLen {
+			return nil, 0, ErrorProxyHeader
+		}
+		h.src = &net.UnixAddr{Name: proxyUnixPath(body[0:108]), Net: "unix"}
+		h.dst = &net.UnixAddr{Name: proxyUnixPath(body[108:216]), Net: "unix"}
+	default:
+		return nil, 0, ErrorProxyHeader
+	}
+	if protocol > 2 {
+		return nil, 0, ErrorProxyHeader
+	}
+	// LOCAL connections are health checks of the proxy itself, and UNSPEC carries no usable address
+	if command == 0 || family == 0x0 || protocol == 0 {
+		h.src, h.dst = nil, nil
+	}
+
+	var tlvs = body[addrLen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, 0, ErrorProxyHeader
+		}
+		var n = 3 + int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < n {
+			return nil, 0, ErrorProxyHeader
+		}
+		h.tlvs = append(h.tlvs, ProxyTLV{Type: tlvs[0], Value: append([]byte(nil), tlvs[3:n]...)})
+		tlvs = tlvs[n:]
+	}
+	return h, size, nil
+}
+
+func proxyUnixPath(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,216 @@
+package epoll
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// a PROXY v2 header with the version and command byte vc, the family and protocol byte fp and body
+func proxyV2(vc byte, fp byte, body []byte) []byte {
+	var h = append([]byte(nil), proxyV2Signature...)
+	h = append(h, vc, fp, 0, 0)
+	binary.BigEndian.PutUint16(h[14:16], uint16(len(body)))
+	return append(h, body...)
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	var inet = []byte{192, 168, 0, 1, 10, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb}
+	var inet6 = make([]byte, 36)
+	inet6[15], inet6[31] = 1, 2
+	binary.BigEndian.PutUint16(inet6[32:], 1000)
+	binary.BigEndian.PutUint16(inet6[34:], 443)
+	var unixAddrs = make([]byte, 216)
+	copy(unixAddrs, "/run/src.sock")
+	copy(unixAddrs[108:], "/run/dst.sock")
+	var tlvs = append(append([]byte(nil), inet...), PROXY_TLV_ALPN, 0, 2, 'h', '2', PROXY_TLV_NOOP, 0, 0)
+
+	var tests = []struct {
+		name string
+		buf  string
+		size int
+		src  string // empty when the header carries no address
+		dst  string
+		tlvs int
+		ok   bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\nGET", 43, "192.168.0.1:56324", "10.0.0.1:443", 0, true},
+		{"v1 tcp6", "PROXY TCP6 ::1 ::2 1000 443\r\n", 29, "[::1]:1000", "[::2]:443", 0, true},
+		{"v1 unknown", "PROXY UNKNOWN whatever\r\n", 24, "", "", 0, true},
+		{"v1 partial", "PROXY TCP4 192.168", 0, "", "", 0, true},
+		{"v1 prefix only", "PRO", 0, "", "", 0, true},
+		{"v1 family mismatch", "PROXY TCP4 ::1 ::2 1000 443\r\n", 0, "", "", 0, false},
+		{"v1 port with leading zero", "PROXY TCP4 1.1.1.1 2.2.2.2 080 443\r\n", 0, "", "", 0, false},
+		{"v1 port out of range", "PROXY TCP4 1.1.1.1 2.2.2.2 65536 443\r\n", 0, "", "", 0, false},
+		{"v1 missing fields", "PROXY TCP4 1.1.1.1 2.2.2.2 80\r\n", 0, "", "", 0, false},
+		{"v1 no CRLF within the limit", "PROXY TCP4 " + string(make([]byte, 100)), 0, "", "", 0, false},
+		{"not a header", "GET / HTTP/1.1\r\n\r\n", 0, "", "", 0, false},
+		{"v2 signature only", string(proxyV2Signature[:8]), 0, "", "", 0, true},
+		{"v2 inet", string(proxyV2(0x21, 0x11, inet)), 28, "192.168.0.1:56324", "10.0.0.1:443", 0, true},
+		{"v2 inet6", string(proxyV2(0x21, 0x21, inet6)), 52, "[::1]:1000", "[::2]:443", 0, true},
+		{"v2 unix", string(proxyV2(0x21, 0x31, unixAddrs)), 232, "/run/src.sock", "/run/dst.sock", 0, true},
+		{"v2 tlvs", string(proxyV2(0x21, 0x11, tlvs)), 36, "192.168.0.1:56324", "10.0.0.1:443", 2, true},
+		{"v2 local", string(proxyV2(0x20, 0x11, inet)), 28, "", "", 0, true},
+		{"v2 unspec", string(proxyV2(0x21, 0x00, nil)), 16, "", "", 0, true},
+		{"v2 body not read yet", string(proxyV2(0x21, 0x11, inet)[:20]), 28, "", "", 0, true},
+		{"v2 version 1", string(proxyV2(0x11, 0x11, inet)), 0, "", "", 0, false},
+		{"v2 unknown command", string(proxyV2(0x22, 0x11, inet)), 0, "", "", 0, false},
+		{"v2 unknown family", string(proxyV2(0x21, 0x41, inet)), 0, "", "", 0, false},
+		{"v2 short address", string(proxyV2(0x21, 0x11, inet[:8])), 0, "", "", 0, false},
+		{"v2 truncated tlv", string(proxyV2(0x21, 0x11, append(append([]byte(nil), inet...), PROXY_TLV_ALPN, 0, 5, 'h'))), 0, "", "", 0, false},
+	}
+	for _, tt := range tests {
+		var h, size, err = parseProxyHeader([]byte(tt.buf))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if size != tt.size {
+			t.Errorf("%s: size %d, want %d", tt.name, size, tt.size)
+			continue
+		}
+		if h == nil {
+			if tt.src != "" {
+				t.Errorf("%s: no header, want source %s", tt.name, tt.src)
+			}
+			continue
+		}
+		var src, dst string
+		if h.src != nil {
+			src, dst = h.src.String(), h.dst.String()
+		}
+		if src != tt.src || dst != tt.dst || len(h.tlvs) != tt.tlvs {
+			t.Errorf("%s: %s -> %s with %d TLVs, want %s -> %s with %d", tt.name, src, dst, len(h.tlvs), tt.src, tt.dst, tt.tlvs)
+		}
+	}
+}
+
+// the addresses of the header replace those of the socket, and the data after it is left for OnReceive
+func TestProxyProtocol(t *testing.T) {
+	var ep = newTestEP(t)
+	ep.SetProxyProtocol(true)
+	var accepted = make(chan ConnID, 1)
+	var received = make(chan string, 1)
+	ep.OnAcceptID = func(id ConnID) { accepted <- id }
+	ep.OnReceive = func(fd int, msg []byte, n int) { received <- string(msg[:n]) }
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListener("127.0.0.1", 0, nil)
+	})
+
+	var body = []byte{192, 168, 0, 1, 10, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb, PROXY_TLV_AUTHORITY, 0, 3, 'a', '.', 'b'}
+	var c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// the header arrives in two parts
+	var header = proxyV2(0x21, 0x11, body)
+	c.Write(header[:10])
+	time.Sleep(20 * time.Millisecond)
+	c.Write(append(header[10:], "hello"...))
+
+	var id ConnID
+	select {
+	case id = <-accepted:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for OnAccept")
+	}
+	if s := receive(t, "OnReceive", received); s != "hello" {
+		t.Fatalf("received %q", s)
+	}
+	var remote net.Addr
+	if remote, err = ep.RemoteAddrByID(id); err != nil || remote.String() != "192.168.0.1:56324" {
+		t.Fatalf("remote address %v %v", remote, err)
+	}
+	var tlvs = ep.GetConnectionProxyTLVs(id.Fd())
+	if len(tlvs) != 1 || tlvs[0].Type != PROXY_TLV_AUTHORITY || string(tlvs[0].Value) != "a.b" {
+		t.Fatalf("TLVs %+v", tlvs)
+	}
+}
+
+// the header comes before the TLS handshake
+func TestProxyProtocolSSL(t *testing.T) {
+	var p = newTestPKI(t)
+	var certFile, keyFile, _ = p.issue(t, "server", []string{"localhost"}, false)
+
+	var ep = newEchoEP(t)
+	ep.SetProxyProtocol(true)
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListenerSSL("127.0.0.1", 0, certFile, keyFile, nil)
+	})
+
+	var c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(testTimeout))
+	c.Write([]byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n"))
+	var tc = tls.Client(c, &tls.Config{ServerName: "localhost", RootCAs: p.pool()})
+	echo(t, tc, "hello over TLS")
+}
+
+func TestProxyHeaderTimeout(t *testing.T) {
+	var ep = newTestEP(t)
+	ep.SetProxyProtocol(true)
+	ep.SetHandshakeTimeout(1)
+	var failed = make(chan error, 1)
+	ep.OnAccept = func(fd int) { t.Errorf("OnAccept without a PROXY header") }
+	ep.OnError = func(fd int, code ErrorCode, err error) {
+		if code == ERROR_PROXY_PROTOCOL {
+			failed <- err
+		}
+	}
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListener("127.0.0.1", 0, nil)
+	})
+
+	var c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4"))
+	select {
+	case err = <-failed:
+		if err != ErrorProxyHeaderTimeout {
+			t.Fatalf("error %v, want ErrorProxyHeaderTimeout", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for the header timeout")
+	}
+	c.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, err = c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection still open after the header timeout")
+	}
+}
+
+func TestProxyHeaderMalformed(t *testing.T) {
+	var ep = newTestEP(t)
+	ep.SetProxyProtocol(true)
+	var failed = make(chan ErrorCode, 1)
+	ep.OnError = func(fd int, code ErrorCode, err error) { failed <- code }
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListener("127.0.0.1", 0, nil)
+	})
+
+	var c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	select {
+	case code := <-failed:
+		if code != ERROR_PROXY_PROTOCOL {
+			t.Fatalf("error code %d, want ERROR_PROXY_PROTOCOL", code)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for the header error")
+	}
+}
@@ -0,0 +1,136 @@
+package epoll
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	REACTOR_MODE_ROUND_ROBIN = 0 // listeners stay on the first loop, new connections are spread over all loops
+	REACTOR_MODE_REUSEPORT   = 1 // every loop gets its own SO_REUSEPORT socket for TCP listeners
+)
+
+type reactor struct {
+	id        int
+	epfd      int
+	wakeFd    int
+	pauseLock sync.Mutex
+	paused    []ConnID // connections whose reading is paused, see SetBackpressure
+}
+
+func (ep *EP) newReactor(id int, epfd int) (*reactor, error) {
+	var wakeFd, err = newWakeFd(epfd)
+	if err != nil {
+		return nil, err
+	}
+	return &reactor{id: id, epfd: epfd, wakeFd: wakeFd}, nil
+}
+
+// runs n event loops, each with its own epoll fd, must be called before listening starts
+// loops cannot be removed, n below the current count is an error
+func (ep *EP) SetReactors(n int) error {
+	if n < 1 || n < len(ep.reactors) {
+		return errors.New(fmt.Sprintf(ErrorTemplateReactorCount, n, len(ep.reactors)))
+	}
+	var err error
+	var epfd int
+	var r *reactor
+	for len(ep.reactors) < n {
+		if epfd, err = unix.EpollCreate1(0); err != nil {
+			return err
+		}
+		if r, err = ep.newReactor(len(ep.reactors), epfd); err != nil {
+			unix.Close(epfd)
+			return err
+		}
+		ep.reactors = append(ep.reactors, r)
+	}
+	return nil
+}
+
+func (ep *EP) SetReactorMode(mode int) {
+	ep.ReactorMode = mode
+}
+
+func (ep *EP) GetReactorCount() int {
+	return len(ep.reactors)
+}
+
+func (ep *EP) nextReactor() *reactor {
+	if len(ep.reactors) == 1 {
+		return ep.reactors[0]
+	}
+	var n = atomic.AddUint32(&ep.reactorCursor, 1)
+	return ep.reactors[int(n%uint32(len(ep.reactors)))]
+}
+
+// epoll fd of the loop that owns the connection
+func (ep *EP) epfdOf(fd int) int {
+	if len(ep.reactors) <= 1 {
+		return ep.Epfd
+	}
+	var epfd = ep.Epfd
+	ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+		var c, ok = value.(*Conn)
+		if ok && c.reactor != nil {
+			epfd = c.reactor.epfd
+		}
+	})
+	return epfd
+}
+
+func (ep *EP) wakeReactors() {
+	var r *reactor
+	for _, r = range ep.reactors {
+		wake(r.wakeFd)
+	}
+}
+
+func (ep *EP) closeReactors() {
+	var r *reactor
+	for _, r = range ep.reactors {
+		unix.Close(r.epfd)
+		unix.Close(r.wakeFd)
+	}
+}
+
+// copies of a TCP listener bound to the other loops in REACTOR_MODE_REUSEPORT,
+// they take the port l is bound to, which the kernel picked if l.Port is 0
+func (ep *EP) addReusePortListeners(l *Listener) error {
+	if ep.ReactorMode != REACTOR_MODE_REUSEPORT || l.Family == unix.AF_UNIX || len(ep.reactors) < 2 {
+		return nil
+	}
+	var sa, err = unix.Getsockname(l.Fd)
+	if err != nil {
+		return err
+	}
+	var port int
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		port = sa.Port
+	case *unix.SockaddrInet6:
+		port = sa.Port
+	}
+	var c *Listener
+	var i int
+	for i = 1; i < len(ep.reactors); i++ {
+		if c, err = ep.newTCPListener(l.Host, port); err != nil {
+			return err
+		}
+		c.IsSSL = l.IsSSL
+		c.SSLCtx = l.SSLCtx
+		c.sslContext = l.sslContext
+		c.sslPool = l.sslPool
+		c.Callbacks = l.Callbacks
+		c.ProxyProtocol = l.ProxyProtocol
+		c.reactor = ep.reactors[i]
+		if err = ep.addListener(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
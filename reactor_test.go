@@ -0,0 +1,73 @@
+package epoll
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connections are served by every loop in both modes, the REUSEPORT copies of a port 0 listener
+// share the port the kernel picked, also with SO_REUSEPORT turned off
+func TestReactors(t *testing.T) {
+	var tests = []struct {
+		name string
+		mode int
+	}{
+		{"round robin", REACTOR_MODE_ROUND_ROBIN},
+		{"reuseport", REACTOR_MODE_REUSEPORT},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ep = newEchoEP(t)
+			if err := ep.SetReactors(3); err != nil {
+				t.Fatal(err)
+			}
+			ep.SetReactorMode(tt.mode)
+			ep.SetReusePort(0)
+			var lock sync.Mutex
+			var loops = make(map[int]bool)
+			ep.OnAccept = func(fd int) {
+				if c := ep.GetConnection(fd); c != nil && c.reactor != nil {
+					lock.Lock()
+					loops[c.reactor.id] = true
+					lock.Unlock()
+				}
+			}
+			var addr = serveTest(t, ep, func() (*Listener, error) {
+				return ep.AddListener("127.0.0.1", 0, nil)
+			})
+
+			var listeners = ep.getListeners()
+			if tt.mode == REACTOR_MODE_REUSEPORT {
+				if len(listeners) != 3 {
+					t.Fatalf("%d listeners, want 3", len(listeners))
+				}
+				var l *Listener
+				for _, l = range listeners {
+					if a := listenerAddr(t, l); a != addr {
+						t.Fatalf("copy bound to %s, want %s", a, addr)
+					}
+				}
+			} else if len(listeners) != 1 {
+				t.Fatalf("%d listeners, want 1", len(listeners))
+			}
+
+			var i int
+			for i = 0; i < 30; i++ {
+				var c, err = net.Dial("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.SetDeadline(time.Now().Add(testTimeout))
+				echo(t, c, "hello")
+				c.Close()
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if len(loops) != 3 {
+				t.Fatalf("connections served by %d loops, want 3", len(loops))
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package epoll
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_CERT_WATCH_CHECK_INTERVAL = 1
+)
+
+// the current SSL_CTX of a listener, shared by its SO_REUSEPORT copies and its SSL pool
+// new handshakes pick up a replaced context, established connections keep the one they started with
+type sslContext struct {
+	ctx   atomic.Value // *sslCtx
+	certs *SSLCertificates
+	files map[string]fileStamp // certificate and key files with their state when loaded
+	opts  sslOptions           // taken when the listener was created, so reloads keep its settings
+	lock  sync.Mutex           // serializes reloads
+	use   sync.RWMutex         // read held from loading ctx until SSL_new has taken a reference, see reloadSSLContext
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func newSSLContext(ctx *sslCtx, certs *SSLCertificates, opts sslOptions) *sslContext {
+	var sc = &sslContext{certs: certs, files: stampCertificates(certs), opts: opts}
+	sc.ctx.Store(ctx)
+	return sc
+}
+
+func (sc *sslContext) get() *sslCtx {
+	return sc.ctx.Load().(*sslCtx)
+}
+
+// loads new certificates for the listener started by StartSSL, connections already established are not affected
+// nothing changes if loading fails
+func (ep *EP) ReloadCertificates(certFile string, keyFile string) error {
+	return ep.ReloadSSLCertificates(&SSLCertificates{Default: SSLCertificate{CertFile: certFile, KeyFile: keyFile}})
+}
+
+func (ep *EP) ReloadSSLCertificates(certs *SSLCertificates) error {
+	var sc = ep.getSSLContext()
+	if sc == nil {
+		return newStartError("ssl", joinHostPort(ep.Host, ep.Port), ErrorSSLNotStarted)
+	}
+	return ep.reloadSSLContext(sc, certs)
+}
+
+// StartSSL blocks, so the context it sets is read by other goroutines, e.g. reloads
+func (ep *EP) setSSLContext(sc *sslContext) {
+	ep.listenerLock.Lock()
+	ep.sslContext = sc
+	ep.listenerLock.Unlock()
+}
+
+func (ep *EP) getSSLContext() *sslContext {
+	ep.listenerLock.Lock()
+	defer ep.listenerLock.Unlock()
+	return ep.sslContext
+}
+
+// like ReloadSSLCertificates for a listener added with AddListenerSSL or AddListenerSSLCertificates
+func (ep *EP) ReloadListenerCertificates(l *Listener, certs *SSLCertificates) error {
+	if l.sslContext == nil {
+		return newStartError("ssl", joinHostPort(l.Host, l.Port), ErrorSSLNotStarted)
+	}
+	return ep.reloadSSLContext(l.sslContext, certs)
+}
+
+func (ep *EP) reloadSSLContext(sc *sslContext, certs *SSLCertificates) error {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	var files = stampCertificates(certs)
+	var ctx, err = newSNISSLCtx(certs, sc.opts)
+	if err != nil {
+		return newStartError("ssl", ep.sslContextAddr(sc), err)
+	}
+
+	// once the write lock is held, every SSL object created from the old context holds a reference to it
+	sc.use.Lock()
+	var old = sc.get()
+	sc.ctx.Store(ctx)
+	sc.use.Unlock()
+	sc.certs = certs
+	sc.files = files
+
+	ep.listenerLock.Lock()
+	var l *Listener
+	for _, l = range ep.getListeners() {
+		if l.sslContext == sc {
+			l.SSLCtx = ctx
+		}
+	}
+	if ep.sslContext == sc {
+		ep.SSLCtx = ctx
+	}
+	ep.listenerLock.Unlock()
+
+	// SSL objects hold their own reference, the old context goes away with the last connection using it
+	freeSSLCtx(old)
+	return nil
+}
+
+func (ep *EP) sslContextAddr(sc *sslContext) string {
+	var l *Listener
+	for _, l = range ep.getListeners() {
+		if l.sslContext == sc {
+			return joinHostPort(l.Host, l.Port)
+		}
+	}
+	return joinHostPort(ep.Host, ep.Port)
+}
+
+// seconds between checks of the certificate and key files, which are reloaded once they change, 0 disables it
+// errors are passed to OnError with ERROR_SSL_RELOAD and the previous certificates stay in use
+func (ep *EP) SetCertificateWatch(n int) {
+	ep.CertWatchInterval = n
+}
+
+func (ep *EP) certWatchLoop() {
+	go func() {
+		var timer = time.NewTicker(DEFAULT_CERT_WATCH_CHECK_INTERVAL * time.Second)
+		defer timer.Stop()
+		var last = time.Now()
+		for {
+			select {
+			case <-ep.done:
+				return
+			case now := <-timer.C:
+				if ep.CertWatchInterval > 0 && now.Sub(last) >= time.Duration(ep.CertWatchInterval)*time.Second {
+					last = now
+					ep.checkCertificates()
+				}
+			}
+		}
+	}()
+}
+
+func (ep *EP) checkCertificates() {
+	var sc *sslContext
+	var seen = make(map[*sslContext]bool)
+	var contexts []*sslContext
+	if sc = ep.getSSLContext(); sc != nil {
+		contexts = append(contexts, sc)
+	}
+	var l *Listener
+	for _, l = range ep.getListeners() {
+		if l.sslContext != nil {
+			contexts = append(contexts, l.sslContext)
+		}
+	}
+	for _, sc = range contexts {
+		if seen[sc] {
+			continue
+		}
+		seen[sc] = true
+		sc.lock.Lock()
+		var certs, changed = sc.certs, certificatesChanged(sc.files)
+		sc.lock.Unlock()
+		if !changed {
+			continue
+		}
+		if err := ep.reloadSSLContext(sc, certs); err != nil {
+			ep.reportError(-1, -1, ERROR_SSL_RELOAD, err)
+		}
+	}
+}
+
+func stampCertificates(certs *SSLCertificates) map[string]fileStamp {
+	var files = make(map[string]fileStamp)
+	var stamp = func(cert SSLCertificate) {
+		var name string
+		for _, name = range []string{cert.CertFile, cert.KeyFile} {
+			if info, err := os.Stat(name); err == nil {
+				files[name] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+			} else {
+				files[name] = fileStamp{}
+			}
+		}
+	}
+	stamp(certs.Default)
+	var cert SSLCertificate
+	for _, cert = range certs.Names {
+		stamp(cert)
+	}
+	return files
+}
+
+// a file being rewritten may be caught halfway, the reload then fails and is retried on the next check
+func certificatesChanged(files map[string]fileStamp) bool {
+	var name string
+	var s fileStamp
+	for name, s = range files {
+		var info, err = os.Stat(name)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(s.modTime) || info.Size() != s.size {
+			return true
+		}
+	}
+	return false
+}
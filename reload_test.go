@@ -0,0 +1,135 @@
+package epoll
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// new handshakes get the reloaded certificate, an established connection keeps working and a failed reload changes nothing
+func TestReloadCertificates(t *testing.T) {
+	var p = newTestPKI(t)
+	var oldCert, oldKey, _ = p.issue(t, "old", []string{"reload.test"}, false)
+	var newCert, newKey, _ = p.issue(t, "new", []string{"reload.test"}, false)
+	var ep = newEchoEP(t)
+	var l *Listener
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		var err error
+		l, err = ep.AddListenerSSL("127.0.0.1", 0, oldCert, oldKey, nil)
+		return l, err
+	})
+
+	var c, err = dialTLS(t, addr, &tls.Config{ServerName: "reload.test", RootCAs: p.pool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if cn := c.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "old" {
+		t.Fatalf("certificate %s, want old", cn)
+	}
+
+	if err = ep.ReloadListenerCertificates(l, &SSLCertificates{Default: SSLCertificate{CertFile: newCert, KeyFile: newKey}}); err != nil {
+		t.Fatal(err)
+	}
+	if cn := presentedCertificate(t, addr, p); cn != "new" {
+		t.Fatalf("certificate %s after the reload, want new", cn)
+	}
+	echo(t, c, "still open")
+
+	var missing = filepath.Join(t.TempDir(), "missing.pem")
+	err = ep.ReloadListenerCertificates(l, &SSLCertificates{Default: SSLCertificate{CertFile: missing, KeyFile: missing}})
+	var se *StartError
+	if !errors.As(err, &se) || se.Op != "ssl" {
+		t.Fatalf("reload of a missing certificate: %v, want a *StartError", err)
+	}
+	if cn := presentedCertificate(t, addr, p); cn != "new" {
+		t.Fatalf("certificate %s after the failed reload, want new", cn)
+	}
+
+	// the listener was added, not started with StartSSL
+	if err = ep.ReloadCertificates(newCert, newKey); !errors.Is(err, ErrorSSLNotStarted) {
+		t.Fatalf("ReloadCertificates: %v, want ErrorSSLNotStarted", err)
+	}
+	if err = ep.ReloadListenerCertificates(&Listener{}, nil); !errors.Is(err, ErrorSSLNotStarted) {
+		t.Fatalf("ReloadListenerCertificates of a plain listener: %v, want ErrorSSLNotStarted", err)
+	}
+}
+
+// a changed file is reloaded by the next check, one that does not load is reported and the certificate in use stays
+func TestCertificateWatch(t *testing.T) {
+	var p = newTestPKI(t)
+	var oldCert, oldKey, _ = p.issue(t, "old", []string{"reload.test"}, false)
+	var newCert, newKey, _ = p.issue(t, "new", []string{"reload.test"}, false)
+	var dir = t.TempDir()
+	var certFile, keyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	copyFile(t, oldCert, certFile)
+	copyFile(t, oldKey, keyFile)
+
+	var ep = newEchoEP(t)
+	var errs = make(chan ErrorCode, 1)
+	ep.OnError = func(fd int, code ErrorCode, err error) { errs <- code }
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListenerSSL("127.0.0.1", 0, certFile, keyFile, nil)
+	})
+
+	ep.checkCertificates()
+	if cn := presentedCertificate(t, addr, p); cn != "old" {
+		t.Fatalf("certificate %s before any change, want old", cn)
+	}
+
+	copyFile(t, newCert, certFile)
+	copyFile(t, newKey, keyFile)
+	ep.checkCertificates()
+	if cn := presentedCertificate(t, addr, p); cn != "new" {
+		t.Fatalf("certificate %s after the change, want new", cn)
+	}
+
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ep.checkCertificates()
+	select {
+	case code := <-errs:
+		if code != ERROR_SSL_RELOAD {
+			t.Fatalf("error code %d, want ERROR_SSL_RELOAD", code)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for OnError")
+	}
+	if cn := presentedCertificate(t, addr, p); cn != "new" {
+		t.Fatalf("certificate %s after the failed reload, want new", cn)
+	}
+}
+
+// the common name of the certificate a new connection to addr is served
+func presentedCertificate(t *testing.T, addr string, p *testPKI) string {
+	var c, err = dialTLS(t, addr, &tls.Config{ServerName: "reload.test", RootCAs: p.pool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echo(t, c, "hello")
+	return c.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+// the modification time is moved ahead, a copy within the same clock tick would look unchanged otherwise
+func copyFile(t *testing.T, src string, dst string) {
+	var b, err = os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(dst, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var info os.FileInfo
+	if info, err = os.Stat(dst); err != nil {
+		t.Fatal(err)
+	}
+	var mtime = info.ModTime().Add(time.Second)
+	if err = os.Chtimes(dst, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
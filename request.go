@@ -3,6 +3,8 @@ package epoll
 import (
 	"errors"
 	"fmt"
+	"os"
+	"sync/atomic"
 )
 
 type Request struct {
@@ -14,6 +16,11 @@ type Request struct {
 	SequenceId int
 	ErrCode    ErrorCode
 	Err        error
+	ConnID     ConnID
+	Listener   *Listener
+	Callbacks  *Callbacks
+	File       *os.File // with OP_SENDFILE, Sent holds the bytes sent and Err why it stopped
+	Sent       int64
 }
 
 func requestRecycleUpdate(ptr interface{}) {
@@ -26,10 +33,14 @@ func requestRecycleUpdate(ptr interface{}) {
 func resetRequest(req *Request) {
 	req.Msg = nil
 	req.Err = nil
+	req.Listener = nil
+	req.Callbacks = nil
+	req.File = nil
 }
 
 func (ep *EP) getRequest() *Request {
 	var req, err = ep.requestPool.Get()
+	ep.metrics.requestPool.get(err)
 	if err == nil {
 		return req.(*Request)
 	}
@@ -44,73 +55,171 @@ func (ep *EP) getRequestItem() *Request {
 	return ep.getRequest()
 }
 
+// counts requests until the worker has handled them, see Shutdown
+func (ep *EP) invoke(sequenceId int, req *Request) {
+	if atomic.LoadInt32(&ep.workersStopped) != 0 {
+		return
+	}
+	atomic.AddInt64(&ep.inflight, 1)
+	ep.threadPoolSequence.Invoke(sequenceId, req)
+}
+
 func (ep *EP) InvokeAccept() {
+	var l = ep.getListener(ep.getListenFd())
+	if l != nil {
+		ep.invokeAccept(l)
+	}
+}
+
+func (ep *EP) invokeAccept(l *Listener) {
 	var sequenceId = ep.GetSequenceId()
-	ep.threadPoolSequence.Invoke(sequenceId, ep.getRequestItemForAccept(sequenceId))
+	ep.invoke(sequenceId, ep.getRequestItemForAccept(l, sequenceId))
 }
 
 func (ep *EP) InvokeReceive(sequenceId int, fd int, msg *[]byte, n int) {
-	ep.threadPoolSequence.Invoke(sequenceId, ep.getRequestItemForReceive(sequenceId, fd, msg, n))
+	ep.invoke(sequenceId, ep.getRequestItemForReceive(nil, sequenceId, fd, msg, n))
+}
+
+func (ep *EP) InvokeAccepted(sequenceId int, fd int) {
+	ep.invoke(sequenceId, ep.getRequestItemForAccepted(nil, sequenceId, fd))
+}
+
+func (ep *EP) InvokeConnect(sequenceId int, fd int) {
+	ep.invoke(sequenceId, ep.getRequestItemForConnect(nil, sequenceId, fd))
+}
+
+func (ep *EP) InvokeDrain(sequenceId int, fd int) {
+	ep.invoke(sequenceId, ep.getRequestItemForDrain(nil, sequenceId, fd))
+}
+
+func (ep *EP) InvokeIdle(sequenceId int, fd int) {
+	ep.invoke(sequenceId, ep.getRequestItemForIdle(nil, sequenceId, fd))
 }
 
 func (ep *EP) InvokeEpollOut(fd int) {
-	ep.threadPoolSequence.Invoke(-1, ep.getRequestItemForEpollOut(fd))
+	ep.invoke(-1, ep.getRequestItemForEpollOut(nil, fd))
 }
 
 func (ep *EP) InvokeClose(sequenceId int, fd int) {
 	if sequenceId < 0 {
 		sequenceId = ep.GetConnectionSequenceId(fd)
 		if sequenceId < 0 {
-			if ep.OnError != nil {
-				var err = errors.New(fmt.Sprintf(ErrorTemplateNotFound, fd))
-				ep.InvokeError(-1, fd, ERROR_CLOSE_CONNECTION, err)
-			}
+			var err = errors.New(fmt.Sprintf(ErrorTemplateNotFound, fd))
+			ep.reportError(-1, fd, ERROR_CLOSE_CONNECTION, err)
 			return
 		}
 	}
-	ep.threadPoolSequence.Invoke(sequenceId, ep.getRequestItemForClose(fd))
+	ep.invoke(sequenceId, ep.getRequestItemForClose(nil, fd))
 }
 
 func (ep *EP) InvokeError(sequenceId int, fd int, code ErrorCode, err error) {
-	ep.threadPoolSequence.Invoke(sequenceId, ep.getRequestItemForError(fd, code, err))
+	ep.invoke(sequenceId, ep.getRequestItemForError(nil, fd, code, err))
+}
+
+// fills the callbacks and the handle of the connection, a nil conn is looked up by fd
+func (ep *EP) bindRequest(req *Request, conn *Conn) {
+	if conn == nil && req.Fd >= 0 {
+		conn, _ = ep.Connections.Get(req.Fd).(*Conn)
+	}
+	if conn != nil {
+		req.Callbacks = ep.getCallbacks(conn.callbacks)
+		req.ConnID = newConnID(req.Fd, conn.Generation)
+	} else {
+		req.Callbacks = &ep.Callbacks
+		req.ConnID = newConnID(req.Fd, 0)
+	}
 }
 
-func (ep *EP) getRequestItemForAccept(sequenceId int) *Request {
+func (ep *EP) getRequestItemForAccept(l *Listener, sequenceId int) *Request {
 	var req = ep.getRequestItem()
 	req.Op = OP_ACCEPT
 	req.SequenceId = sequenceId
+	req.Listener = l
+	req.Callbacks = ep.getCallbacks(l.Callbacks)
 	return req
 }
 
-func (ep *EP) getRequestItemForReceive(sequenceId int, fd int, msg *[]byte, n int) *Request {
+func (ep *EP) getRequestItemForReceive(conn *Conn, sequenceId int, fd int, msg *[]byte, n int) *Request {
 	var req = ep.getRequestItem()
 	req.Op = OP_RECEIVE
 	req.Fd = fd
+	ep.bindRequest(req, conn)
 	req.SequenceId = sequenceId
 	req.Msg = *msg
 	req.N = n
 	return req
 }
 
-func (ep *EP) getRequestItemForEpollOut(fd int) *Request {
+func (ep *EP) getRequestItemForAccepted(conn *Conn, sequenceId int, fd int) *Request {
+	var req = ep.getRequestItem()
+	req.Op = OP_ACCEPTED
+	req.Fd = fd
+	ep.bindRequest(req, conn)
+	req.SequenceId = sequenceId
+	return req
+}
+
+func (ep *EP) getRequestItemForConnect(conn *Conn, sequenceId int, fd int) *Request {
+	var req = ep.getRequestItem()
+	req.Op = OP_CONNECT
+	req.Fd = fd
+	ep.bindRequest(req, conn)
+	req.SequenceId = sequenceId
+	return req
+}
+
+func (ep *EP) getRequestItemForDrain(conn *Conn, sequenceId int, fd int) *Request {
+	var req = ep.getRequestItem()
+	req.Op = OP_DRAIN
+	req.Fd = fd
+	ep.bindRequest(req, conn)
+	req.SequenceId = sequenceId
+	return req
+}
+
+func (ep *EP) getRequestItemForIdle(conn *Conn, sequenceId int, fd int) *Request {
+	var req = ep.getRequestItem()
+	req.Op = OP_IDLE
+	req.Fd = fd
+	ep.bindRequest(req, conn)
+	req.SequenceId = sequenceId
+	return req
+}
+
+func (ep *EP) getRequestItemForSendFile(conn *Conn, sequenceId int, fd int, f *fileSend) *Request {
+	var req = ep.getRequestItem()
+	req.Op = OP_SENDFILE
+	req.Fd = fd
+	ep.bindRequest(req, conn)
+	req.SequenceId = sequenceId
+	req.File = f.file
+	req.Sent = f.sent
+	req.Err = f.err
+	return req
+}
+
+func (ep *EP) getRequestItemForEpollOut(conn *Conn, fd int) *Request {
 	var req = ep.getRequestItem()
 	req.Op = OP_EPOLLOUT
 	req.Fd = fd
+	ep.bindRequest(req, conn)
 	req.SequenceId = -1
 	return req
 }
 
-func (ep *EP) getRequestItemForClose(fd int) *Request {
+func (ep *EP) getRequestItemForClose(conn *Conn, fd int) *Request {
 	var req = ep.getRequestItem()
 	req.Op = OP_CLOSE
 	req.Fd = fd
+	ep.bindRequest(req, conn)
 	return req
 }
 
-func (ep *EP) getRequestItemForError(fd int, errCode ErrorCode, err error) *Request {
+func (ep *EP) getRequestItemForError(conn *Conn, fd int, errCode ErrorCode, err error) *Request {
 	var req = ep.getRequestItem()
 	req.Op = OP_ERROR
 	req.Fd = fd
+	ep.bindRequest(req, conn)
 	req.ErrCode = errCode
 	req.Err = err
 	return req
@@ -0,0 +1,179 @@
+package epoll
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// writes what the socket accepts now and queues the rest, which is flushed on EPOLLOUT
+func (ep *EP) Send(fd int, msg []byte) error {
+	var conn *Conn
+	var id ConnID
+	ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+		var c, ok = value.(*Conn)
+		if ok {
+			c.Timestamp = time.Now().Unix()
+			conn, id = c, c.ConnID()
+		}
+	})
+	if conn == nil {
+		return errors.New(fmt.Sprintf(ErrorTemplateNotFound, fd))
+	}
+	return ep.send(conn, id, msg)
+}
+
+// the generation is checked under outLock, which resetConn also takes before the fd is closed
+func (ep *EP) send(conn *Conn, id ConnID, msg []byte) error {
+	if len(msg) == 0 {
+		return nil
+	}
+
+	conn.outLock.Lock()
+	defer conn.outLock.Unlock()
+
+	if conn.Generation != id.Generation() {
+		return ErrorConnIDStale
+	}
+
+	var pending = len(conn.outbound)
+	if ep.HighWatermark > 0 && pending+len(msg) > ep.HighWatermark {
+		return ErrorWriteQueueFull
+	}
+
+	// bytes sent after a queued file wait for it
+	if pending > 0 || len(conn.files) > 0 {
+		conn.outbound = append(conn.outbound, msg...)
+		return nil
+	}
+
+	// TLS records are only written by the event loop, which reads and handshakes on the same SSL object
+	var n int
+	if conn.SSL == nil || conn.ktlsSend {
+		var err error
+		if n, err = ep.writeConn(conn, msg); err != nil {
+			return err
+		}
+		if n == len(msg) {
+			return nil
+		}
+	}
+	conn.outbound = append(conn.outbound, msg[n:]...)
+	// not EnableEpollOut, which takes the map lock while outLock is held
+	return ep.setEventsLocked(conn, atomic.LoadInt32(&conn.paused) == 0)
+}
+
+func (ep *EP) GetSendQueueLength(fd int) int {
+	var conn = ep.GetConnection(fd)
+	if conn == nil {
+		return 0
+	}
+	conn.outLock.Lock()
+	defer conn.outLock.Unlock()
+	return len(conn.outbound)
+}
+
+// returns the number of bytes written, 0 when the socket is not writable
+func (ep *EP) writeConn(conn *Conn, msg []byte) (int, error) {
+	if conn.SSL != nil && !conn.ktlsSend {
+		var n = len(msg)
+		if conn.sslWriteLen > 0 {
+			n = conn.sslWriteLen
+		}
+		conn.sslLock.Lock()
+		var ret, errno = sslWrite(conn.SSL.SSL, msg, n)
+		conn.sslLock.Unlock()
+		if ret > 0 {
+			ep.countWrite(ret)
+			conn.sslWriteLen = 0
+			return ret, nil
+		}
+		if errno == SSL_ERROR_WANT_WRITE || errno == SSL_ERROR_WANT_READ {
+			// OpenSSL requires the retry to repeat the same length
+			conn.sslWriteLen = n
+			return 0, nil
+		}
+		return 0, GetSSLError(errno)
+	}
+
+	var n, err = unix.Write(conn.Fd, msg)
+	ep.countWrite(n)
+	if err != nil {
+		if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+// runs on the event loop, returns false if the connection has been closed
+// queued files are sent once the outbound bytes before their mark have been written
+func (ep *EP) flush(fd int, conn *Conn) bool {
+	conn.outLock.Lock()
+
+	var before = len(conn.outbound)
+	if before == 0 && len(conn.files) == 0 {
+		conn.outLock.Unlock()
+		return true
+	}
+
+	var err error
+	var sent bool
+	var n, written, end int
+	var done []*fileSend
+	for {
+		end = before
+		if len(conn.files) > 0 {
+			end = conn.files[0].mark
+		}
+		for written < end {
+			if n, err = ep.writeConn(conn, conn.outbound[written:end]); err != nil || n == 0 {
+				break
+			}
+			written += n
+		}
+		if written < end || len(conn.files) == 0 {
+			break
+		}
+		if sent, err = ep.writeFile(conn, conn.files[0]); !sent {
+			if err != nil {
+				conn.files[0].err = err
+			}
+			break
+		}
+		done = append(done, conn.files[0])
+		conn.files = conn.files[1:]
+	}
+	conn.outbound = conn.outbound[:copy(conn.outbound, conn.outbound[written:])]
+	var f *fileSend
+	for _, f = range conn.files {
+		f.mark -= written
+	}
+	var after = len(conn.outbound)
+	if err == nil && after == 0 && len(conn.files) == 0 {
+		// under outLock, so EPOLLOUT set meanwhile by send is not removed
+		ep.setEventsLocked(conn, atomic.LoadInt32(&conn.paused) == 0)
+	}
+	var reqs = ep.getRequestItemsForSendFile(conn, done)
+	var drain *Request
+	if err == nil && before > ep.LowWatermark && after <= ep.LowWatermark && ep.getCallbacks(conn.callbacks).hasDrain() {
+		drain = ep.getRequestItemForDrain(conn, conn.SequenceId, fd)
+	}
+	var sequenceId = conn.SequenceId
+
+	conn.outLock.Unlock()
+
+	ep.invokeRequests(reqs)
+	if err != nil {
+		ep.closeAction(CLOSE_REASON_ERROR, sequenceId, fd)
+		return false
+	}
+	if drain != nil {
+		ep.invoke(sequenceId, drain)
+	}
+	return true
+}
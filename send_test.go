@@ -0,0 +1,69 @@
+package epoll
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Send queues what the socket does not take up to the high watermark, the queue is flushed
+// once the peer reads and OnDrain fires when it has fallen to the low watermark
+func TestWriteWatermark(t *testing.T) {
+	var ep = newTestEP(t)
+	ep.SetWriteWatermark(1024, 256<<10)
+	var sent = make(chan int, 1)
+	var drained = make(chan int, 1)
+	ep.OnAcceptID = func(id ConnID) {
+		var chunk = make([]byte, 16<<10)
+		var total, i int
+		for i = 0; i < 4096; i++ {
+			if err := ep.SendByID(id, chunk); err == ErrorWriteQueueFull {
+				break
+			} else if err != nil {
+				t.Errorf("SendByID: %v", err)
+				break
+			}
+			total += len(chunk)
+		}
+		if n, _ := ep.GetSendQueueLengthByID(id); n == 0 || n > 256<<10 {
+			t.Errorf("send queue length %d", n)
+		}
+		sent <- total
+	}
+	ep.OnDrainID = func(id ConnID) {
+		var n, _ = ep.GetSendQueueLengthByID(id)
+		drained <- n
+	}
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListener("127.0.0.1", 0, nil)
+	})
+
+	var c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(testTimeout))
+	var total int
+	select {
+	case total = <-sent:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for the queue to fill")
+	}
+	if total == 16<<10*4096 {
+		t.Fatal("the high watermark was never reached")
+	}
+	var n int64
+	if n, err = io.CopyN(io.Discard, c, int64(total)); err != nil {
+		t.Fatalf("read %d of %d bytes: %v", n, total, err)
+	}
+	select {
+	case queued := <-drained:
+		if queued > 1024 {
+			t.Fatalf("OnDrain with %d bytes queued", queued)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for OnDrain")
+	}
+}
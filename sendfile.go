@@ -0,0 +1,195 @@
+package epoll
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	DEFAULT_SENDFILE_CHUNK = 1 << 20 // most bytes a single sendfile call is asked for
+)
+
+// a file queued with SendFile, sent once the outbound bytes queued before it are written
+type fileSend struct {
+	file      *os.File
+	fd        int
+	offset    int64
+	remaining int64
+	sent      int64
+	mark      int     // length of outbound when queued, kept relative to the start of outbound by flush
+	buffer    *[]byte // read from the file for TLS connections, written from pos to end
+	pos       int
+	end       int
+	err       error
+}
+
+// sends length bytes of file starting at offset after the data already queued, -1 sends up to the end of the file
+// plaintext and kTLS connections use sendfile(2), TLS connections in user space go through a pool buffer
+// the event loop sends the file as the socket accepts it, OnSendFile is called once it is done or has failed,
+// the file must stay open until then
+func (ep *EP) SendFile(fd int, file *os.File, offset int64, length int64) error {
+	var conn *Conn
+	var id ConnID
+	ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+		var c, ok = value.(*Conn)
+		if ok {
+			c.Timestamp = time.Now().Unix()
+			conn, id = c, c.ConnID()
+		}
+	})
+	if conn == nil {
+		return errors.New(fmt.Sprintf(ErrorTemplateNotFound, fd))
+	}
+	return ep.sendFile(conn, id, file, offset, length)
+}
+
+func (ep *EP) SendFileByID(id ConnID, file *os.File, offset int64, length int64) error {
+	var conn, err = ep.GetConnectionByID(id)
+	if err != nil {
+		return err
+	}
+	return ep.sendFile(conn, id, file, offset, length)
+}
+
+func (ep *EP) sendFile(conn *Conn, id ConnID, file *os.File, offset int64, length int64) error {
+	if length < 0 {
+		var info, err = file.Stat()
+		if err != nil {
+			return err
+		}
+		if length = info.Size() - offset; length < 0 {
+			length = 0
+		}
+	}
+
+	conn.outLock.Lock()
+	defer conn.outLock.Unlock()
+
+	if conn.Generation != id.Generation() {
+		return ErrorConnIDStale
+	}
+
+	conn.files = append(conn.files, &fileSend{
+		file:      file,
+		fd:        int(file.Fd()),
+		offset:    offset,
+		remaining: length,
+		mark:      len(conn.outbound),
+	})
+	if len(conn.outbound) > 0 || len(conn.files) > 1 {
+		return nil
+	}
+	// EPOLLOUT fires right away when the socket is writable, flush then sends the file on the event loop
+	return ep.setEventsLocked(conn, atomic.LoadInt32(&conn.paused) == 0)
+}
+
+// runs with outLock held, returns whether the file has been sent, false when the socket is full
+func (ep *EP) writeFile(conn *Conn, f *fileSend) (bool, error) {
+	var n int
+	var err error
+	for f.remaining > 0 {
+		if conn.SSL == nil || conn.ktlsSend {
+			var chunk = f.remaining
+			if chunk > DEFAULT_SENDFILE_CHUNK {
+				chunk = DEFAULT_SENDFILE_CHUNK
+			}
+			n, err = unix.Sendfile(conn.Fd, f.fd, &f.offset, int(chunk))
+			if n > 0 {
+				ep.countWrite(n)
+				f.remaining -= int64(n)
+				f.sent += int64(n)
+				continue
+			}
+			if err == unix.EINTR {
+				continue
+			}
+			if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			return false, ErrorSendFileShort
+		}
+
+		if f.pos == f.end {
+			if f.buffer == nil {
+				if f.buffer, err = ep.GetBuffer(); err != nil {
+					return false, err
+				}
+			}
+			var size = cap(*f.buffer)
+			if int64(size) > f.remaining {
+				size = int(f.remaining)
+			}
+			if n, err = unix.Pread(f.fd, (*f.buffer)[:size], f.offset); n <= 0 {
+				if err == unix.EINTR {
+					continue
+				}
+				if err != nil {
+					return false, err
+				}
+				return false, ErrorSendFileShort
+			}
+			f.offset += int64(n)
+			f.pos, f.end = 0, n
+		}
+		if n, err = ep.writeConn(conn, (*f.buffer)[f.pos:f.end]); err != nil || n == 0 {
+			return false, err
+		}
+		f.pos += n
+		f.remaining -= int64(n)
+		f.sent += int64(n)
+	}
+	ep.releaseFile(f)
+	return true, nil
+}
+
+func (ep *EP) releaseFile(f *fileSend) {
+	if f.buffer != nil {
+		ep.PutBuffer(f.buffer)
+		f.buffer = nil
+	}
+}
+
+// files still queued are reported with the error that stopped them or ErrorSendFileAborted
+func (ep *EP) abortFiles(conn *Conn) []*Request {
+	conn.outLock.Lock()
+	defer conn.outLock.Unlock()
+
+	var f *fileSend
+	for _, f = range conn.files {
+		ep.releaseFile(f)
+		if f.err == nil {
+			f.err = ErrorSendFileAborted
+		}
+	}
+	var reqs = ep.getRequestItemsForSendFile(conn, conn.files)
+	conn.files = nil
+	return reqs
+}
+
+// built with outLock held, invoked once it is released
+func (ep *EP) getRequestItemsForSendFile(conn *Conn, files []*fileSend) []*Request {
+	if len(files) == 0 || !ep.getCallbacks(conn.callbacks).hasSendFile() {
+		return nil
+	}
+	var reqs = make([]*Request, 0, len(files))
+	var f *fileSend
+	for _, f = range files {
+		reqs = append(reqs, ep.getRequestItemForSendFile(conn, conn.SequenceId, conn.Fd, f))
+	}
+	return reqs
+}
+
+func (ep *EP) invokeRequests(reqs []*Request) {
+	var req *Request
+	for _, req = range reqs {
+		ep.invoke(req.SequenceId, req)
+	}
+}
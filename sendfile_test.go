@@ -0,0 +1,154 @@
+package epoll
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type sendFileResult struct {
+	n   int64
+	err error
+}
+
+// a file much larger than the socket buffers, so it is sent over many EPOLLOUT events
+func newTestFile(t *testing.T, size int) (*os.File, []byte) {
+	var data = make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	var name = filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var file, err = os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file, data
+}
+
+// serves the file between two messages to every connection, with TLS if p is set,
+// and returns the address and the results of OnSendFile
+func serveFile(t *testing.T, p *testPKI, file *os.File, offset int64, length int64) (string, <-chan sendFileResult) {
+	var ep = newTestEP(t)
+	var results = make(chan sendFileResult, 1)
+	ep.OnAccept = func(fd int) {
+		ep.Send(fd, []byte("head"))
+		if err := ep.SendFile(fd, file, offset, length); err != nil {
+			t.Errorf("SendFile: %v", err)
+		}
+		ep.Send(fd, []byte("tail"))
+	}
+	ep.OnSendFile = func(fd int, f *os.File, n int64, err error) {
+		if f != file {
+			t.Errorf("OnSendFile for another file")
+		}
+		results <- sendFileResult{n, err}
+	}
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		if p == nil {
+			return ep.AddListener("127.0.0.1", 0, nil)
+		}
+		var certFile, keyFile, _ = p.issue(t, "server", []string{"localhost"}, false)
+		return ep.AddListenerSSL("127.0.0.1", 0, certFile, keyFile, nil)
+	})
+	return addr, results
+}
+
+func dialFile(t *testing.T, p *testPKI, addr string) net.Conn {
+	var c net.Conn
+	var err error
+	if p == nil {
+		c, err = net.Dial("tcp", addr)
+	} else {
+		c, err = dialTLS(t, addr, &tls.Config{ServerName: "localhost", RootCAs: p.pool()})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(testTimeout))
+	return c
+}
+
+func TestSendFile(t *testing.T) {
+	var file, data = newTestFile(t, 4<<20)
+	var tests = []struct {
+		name   string
+		tls    bool
+		offset int64
+		length int64
+	}{
+		{"whole file", false, 0, -1},
+		{"range", false, 1000, 100000},
+		{"empty range", false, 10, 0},
+		{"TLS whole file", true, 0, -1},
+		{"TLS range", true, 1000, 100000},
+	}
+	for _, tt := range tests {
+		var p *testPKI
+		if tt.tls {
+			p = newTestPKI(t)
+		}
+		var addr, results = serveFile(t, p, file, tt.offset, tt.length)
+		var want = data[tt.offset:]
+		if tt.length >= 0 {
+			want = want[:tt.length]
+		}
+		want = append(append([]byte("head"), want...), "tail"...)
+
+		var c = dialFile(t, p, addr)
+		// the socket fills up before anything is read
+		time.Sleep(50 * time.Millisecond)
+		var got = make([]byte, len(want))
+		var _, err = io.ReadFull(c, got)
+		c.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: received data differs", tt.name)
+		}
+		select {
+		case r := <-results:
+			if r.err != nil || r.n != int64(len(want)-8) {
+				t.Fatalf("%s: OnSendFile %d %v, want %d", tt.name, r.n, r.err, len(want)-8)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("%s: timed out waiting for OnSendFile", tt.name)
+		}
+	}
+}
+
+// a peer leaving during the transfer stops it, OnSendFile reports the bytes sent until then and an error
+func TestSendFileAborted(t *testing.T) {
+	var file, _ = newTestFile(t, 16<<20)
+	var useTLS bool
+	for _, useTLS = range []bool{false, true} {
+		var p *testPKI
+		if useTLS {
+			p = newTestPKI(t)
+		}
+		var addr, results = serveFile(t, p, file, 0, -1)
+		var c = dialFile(t, p, addr)
+		if _, err := io.ReadFull(c, make([]byte, 100000)); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		select {
+		case r := <-results:
+			if r.err == nil || r.n <= 0 || r.n >= 16<<20 {
+				t.Fatalf("TLS %v: OnSendFile %d %v, want a partial transfer and an error", useTLS, r.n, r.err)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("TLS %v: timed out waiting for OnSendFile", useTLS)
+		}
+	}
+}
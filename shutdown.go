@@ -0,0 +1,120 @@
+package epoll
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	DEFAULT_SHUTDOWN_POLL_INTERVAL = 10 // milliseconds
+)
+
+// stops accepting and reading, waits for the thread pool and pending writes to finish,
+// closes every connection through OnClose and then stops the EP.
+// If ctx expires first, the remaining connections are closed without OnClose
+// Must not be called from a callback, which would wait for itself until ctx expires,
+// start it on another goroutine instead
+func (ep *EP) Shutdown(ctx context.Context) error {
+	// clients that keep sending would otherwise keep the thread pool busy
+	atomic.StoreInt32(&ep.draining, 1)
+	ep.closeListeners()
+	ep.closeDials()
+
+	var err error
+	if err = ep.waitFor(ctx, ep.isQuiescent); err == nil {
+		ep.closeGracefully()
+		err = ep.waitFor(ctx, func() bool {
+			return ep.GetConnectionCount() == 0 && atomic.LoadInt64(&ep.inflight) == 0
+		})
+	}
+
+	ep.Stop()
+	return err
+}
+
+func (ep *EP) waitFor(ctx context.Context, cond func() bool) error {
+	var timer = time.NewTicker(DEFAULT_SHUTDOWN_POLL_INTERVAL * time.Millisecond)
+	defer timer.Stop()
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+func (ep *EP) isQuiescent() bool {
+	if atomic.LoadInt64(&ep.inflight) > 0 {
+		return false
+	}
+	var pending bool
+	ep.Connections.Iterate(func(key interface{}, value interface{}) {
+		var c, ok = value.(*Conn)
+		if ok && !pending {
+			c.outLock.Lock()
+			pending = len(c.outbound) > 0 || len(c.files) > 0
+			c.outLock.Unlock()
+		}
+	})
+	return !pending
+}
+
+func (ep *EP) closeGracefully() {
+	var fds []int
+	var handshaking []ConnID
+	ep.Connections.Iterate(func(key interface{}, value interface{}) {
+		var fd, ok1 = key.(int)
+		var c, ok2 = value.(*Conn)
+		if ok1 && ok2 {
+			// the PROXY header counts as part of the handshake, OnAccept has not been called yet
+			if atomic.LoadInt32(&c.handshake) == HANDSHAKE_NONE {
+				fds = append(fds, fd)
+			} else {
+				handshaking = append(handshaking, c.ConnID())
+			}
+		}
+	})
+	var fd int
+	for _, fd = range fds {
+		ep.closeAction(CLOSE_REASON_SHUTDOWN, -1, fd)
+	}
+	var id ConnID
+	for _, id = range handshaking {
+		ep.dropConnectionByID(id, CLOSE_REASON_SHUTDOWN)
+	}
+}
+
+func newWakeFd(epfd int) (int, error) {
+	var fd, err = unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		return -1, err
+	}
+	var event = &unix.EpollEvent{
+		Events: unix.EPOLLIN,
+		Fd:     int32(fd),
+	}
+	if err = unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, fd, event); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func wake(fd int) {
+	var b = [8]byte{1}
+	unix.Write(fd, b[:])
+}
+
+func (ep *EP) isStopped() bool {
+	select {
+	case <-ep.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,112 @@
+package epoll
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Shutdown stops accepting, waits until the queued bytes have been read and closes with OnClose
+func TestShutdownDrain(t *testing.T) {
+	var ep = newTestEP(t)
+	var sent = make(chan int, 1)
+	var closed = make(chan struct{}, 1)
+	ep.OnAcceptID = func(id ConnID) { sent <- fillSendQueue(t, ep, id) }
+	ep.OnClose = func(fd int) { closed <- struct{}{} }
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListener("127.0.0.1", 0, nil)
+	})
+
+	var c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(testTimeout))
+	var total = <-sent
+
+	var done = make(chan error, 1)
+	go func() {
+		var ctx, cancel = context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		done <- ep.Shutdown(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err = <-done:
+		t.Fatalf("Shutdown returned %v before the queue was read", err)
+	default:
+	}
+
+	var n int64
+	if n, err = io.CopyN(io.Discard, c, int64(total)); err != nil {
+		t.Fatalf("read %d of %d bytes: %v", n, total, err)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for Shutdown")
+	}
+	select {
+	case <-closed:
+	default:
+		t.Fatal("no OnClose before Shutdown returned")
+	}
+	if n := ep.Stats().Closes[CLOSE_REASON_SHUTDOWN]; n != 1 {
+		t.Fatalf("%d connections closed by Shutdown, want 1", n)
+	}
+	if _, err = c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection still open after Shutdown")
+	}
+	if c, err = net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Fatal("listener still open after Shutdown")
+	}
+}
+
+// a peer that never reads makes Shutdown give up at the deadline and close the connection anyway
+func TestShutdownDeadline(t *testing.T) {
+	var ep = newTestEP(t)
+	var sent = make(chan int, 1)
+	ep.OnAcceptID = func(id ConnID) { sent <- fillSendQueue(t, ep, id) }
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListener("127.0.0.1", 0, nil)
+	})
+
+	var c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	<-sent
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = ep.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown: %v, want context.DeadlineExceeded", err)
+	}
+	if n := ep.GetConnectionCount(); n != 0 {
+		t.Fatalf("%d connections left after Shutdown", n)
+	}
+}
+
+// sends until the socket buffers are full and something is queued, returns the bytes sent
+func fillSendQueue(t *testing.T, ep *EP, id ConnID) int {
+	var chunk = make([]byte, 64<<10)
+	var total int
+	for {
+		if err := ep.SendByID(id, chunk); err != nil {
+			t.Errorf("SendByID: %v", err)
+			return total
+		}
+		total += len(chunk)
+		if n, _ := ep.GetSendQueueLengthByID(id); n > 0 {
+			return total
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package epoll
+
+type SSLCertificate struct {
+	CertFile string
+	KeyFile  string
+}
+
+// certificates picked by the server name the client sends with SNI
+// a name is exact, e.g. "example.com", or a wildcard for one label, e.g. "*.example.com", exact names win
+// Default is presented when the client sends no name or no name matches
+type SSLCertificates struct {
+	Default SSLCertificate
+	Names   map[string]SSLCertificate
+}
+
+// the server name sent by the client with SNI, empty until the handshake has completed
+func (ep *EP) GetConnectionServerName(fd int) string {
+	var name string
+	ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+		var c, ok = value.(*Conn)
+		if ok {
+			name = c.ServerName
+		}
+	})
+	return name
+}
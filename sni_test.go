@@ -0,0 +1,56 @@
+package epoll
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+// the certificate is picked by the exact name, then by a wildcard for one label, else the default is presented
+func TestSNI(t *testing.T) {
+	var p = newTestPKI(t)
+	var defaultCert, defaultKey, _ = p.issue(t, "default", []string{"default.test"}, false)
+	var exactCert, exactKey, _ = p.issue(t, "exact", []string{"exact.example.com"}, false)
+	var wildCert, wildKey, _ = p.issue(t, "wildcard", []string{"*.example.com"}, false)
+
+	var ep = newEchoEP(t)
+	var names = make(chan string, 1)
+	ep.OnAccept = func(fd int) { names <- ep.GetConnectionServerName(fd) }
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListenerSSLCertificates("127.0.0.1", 0, &SSLCertificates{
+			Default: SSLCertificate{CertFile: defaultCert, KeyFile: defaultKey},
+			Names: map[string]SSLCertificate{
+				"exact.example.com": {CertFile: exactCert, KeyFile: exactKey},
+				"*.example.com":     {CertFile: wildCert, KeyFile: wildKey},
+			},
+		}, nil)
+	})
+
+	var tests = []struct {
+		serverName string
+		cert       string
+	}{
+		{"exact.example.com", "exact"},
+		{"EXACT.example.com", "exact"},
+		{"other.example.com", "wildcard"},
+		{"a.b.example.com", "default"},
+		{"example.com", "default"},
+		{"default.test", "default"},
+		{"", "default"},
+	}
+	for _, tt := range tests {
+		// verified below by the name of the certificate, which the default one does not match for every name
+		var c, err = dialTLS(t, addr, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("%q: %v", tt.serverName, err)
+		}
+		echo(t, c, "hello")
+		var state = c.ConnectionState()
+		if cn := state.PeerCertificates[0].Subject.CommonName; cn != tt.cert {
+			t.Errorf("%q: certificate %s, want %s", tt.serverName, cn, tt.cert)
+		}
+		if name := receive(t, "OnAccept", names); name != tt.serverName {
+			t.Errorf("%q: server name %q", tt.serverName, name)
+		}
+		c.Close()
+	}
+}
@@ -1,29 +1,12 @@
 package epoll
 
-/*
-#cgo LDFLAGS: -lssl -lcrypto -ldl
-#ifdef __linux__
-#include <malloc.h>
-#elif __APPLE__
-#include <malloc/malloc.h>
-#else
-# error "Unknown compiler"
-#endif
-#include <stdint.h>
-#include <stdio.h>
-#include <string.h>
-#include <openssl/evp.h>
-#include <openssl/rand.h>
-#include <openssl/ssl.h>
-#include <openssl/dh.h>
-#include <openssl/err.h>
-#include <openssl/crypto.h>
-*/
-import "C"
 import (
-	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
-	"unsafe"
+
+	"golang.org/x/sys/unix"
 
 	"github.com/wuyongjia/hashmap"
 	"github.com/wuyongjia/pool"
@@ -32,41 +15,98 @@ import (
 
 const (
 	SSL_ERROR_TIMEOUT      = -9
-	SSL_ERROR_NONE         = int(C.SSL_ERROR_NONE)
-	SSL_ERROR_SSL          = int(C.SSL_ERROR_SSL)
-	SSL_ERROR_WANT_READ    = int(C.SSL_ERROR_WANT_READ)
-	SSL_ERROR_WANT_WRITE   = int(C.SSL_ERROR_WANT_WRITE)
-	SSL_ERROR_SYSCALL      = int(C.SSL_ERROR_SYSCALL)
-	SSL_ERROR_ZERO_RETURN  = int(C.SSL_ERROR_ZERO_RETURN)
-	SSL_ERROR_WANT_CONNECT = int(C.SSL_ERROR_WANT_CONNECT)
+	SSL_ERROR_NONE         = 0 // the values of SSL_get_error, also used by the crypto/tls backend
+	SSL_ERROR_SSL          = 1
+	SSL_ERROR_WANT_READ    = 2
+	SSL_ERROR_WANT_WRITE   = 3
+	SSL_ERROR_SYSCALL      = 5
+	SSL_ERROR_ZERO_RETURN  = 6
+	SSL_ERROR_WANT_CONNECT = 7
 )
 
 const (
 	DEFAULT_C_MALLOC_TRIM_INTERVAL = 5000
+	DEFAULT_SSL_HANDSHAKE_TIMEOUT  = 10
 )
 
 type SSL struct {
-	Id  uint64
-	SSL *C.SSL
+	Id   uint64
+	SSL  *sslHandle
+	ctx  *sslCtx // the context SSL was created with
+	pool *pool.Pool
 }
 
 type Conn struct {
-	Id         uint64
-	Fd         int
-	SSL        *SSL
-	Data       interface{}
-	SequenceId int
-	Timestamp  int64
-	Status     int
+	Id          uint64
+	Fd          int
+	Generation  uint32 // changes every time the Conn is reused, see ConnID
+	pending     int32  // receive requests not yet handled, see SetBackpressure
+	peerIP      net.IP // counted against MaxConnectionsPerIP
+	paused      int32
+	SSL         *SSL
+	sslLock     sync.Mutex // held around every call on SSL, an OpenSSL object must not be used by two threads at once
+	Data        interface{}
+	SequenceId  int
+	Family      int
+	Cred        *unix.Ucred
+	RemoteAddr  net.Addr // *net.TCPAddr or *net.UnixAddr
+	LocalAddr   net.Addr
+	Timestamp   int64
+	Status      int
+	handshake   int32 // HANDSHAKE_*, set to HANDSHAKE_EXPIRED by the timer goroutine, always accessed atomically
+	hsTimer     *time.Timer
+	outbound    []byte
+	outLock     sync.Mutex
+	inbound     []byte // partial frame kept for the Codec
+	sslWriteLen int
+	Listener    *Listener  // nil for dialed and established connections
+	callbacks   *Callbacks // nil uses the callbacks of the EP
+	reactor     *reactor
+	proxy       bool       // the PROXY protocol header has not been read yet
+	ProxyTLVs   []ProxyTLV // TLVs of the PROXY v2 header
+	ServerName  string     // sent by the client with SNI
+	peerCerts   [][]byte   // DER of the client certificate and its chain
+	Protocol    string     // negotiated with ALPN
+	ktlsSend    bool       // records are encrypted by the kernel, see SetKTLS
+	ktlsRecv    bool
+	files       []*fileSend
+	seqpacket   bool // AF_UNIX SOCK_SEQPACKET, read one message at a time
+}
+
+type Listener struct {
+	Id        int
+	Fd        int
+	Host      string
+	Port      int
+	Family    int
+	Path      string
+	IsSSL     bool
+	SSLCtx    *sslCtx
+	sslPool   *pool.Pool // *SSL pool, return *SSL
+	Callbacks *Callbacks // nil uses the callbacks of the EP
+	reactor   *reactor   // nil for the first loop
+
+	ProxyProtocol bool        // connections start with a PROXY protocol header, see SetProxyProtocol
+	sslContext    *sslContext // current SSL_CTX, replaced by ReloadCertificates
+
+	fdLock sync.RWMutex // read held by accept, Fd is closed under the write lock so it cannot be reused meanwhile
 }
 
 type EP struct {
 	Host               string
 	Port               int
+	Family             int
+	Path               string
 	Epfd               int
 	Fd                 int
 	Connections        *hashmap.HM
-	SSLCtx             *C.SSL_CTX
+	listeners          atomic.Value // []*Listener
+	listenerFds        atomic.Value // map[int]*Listener of the open listeners, looked up on every event
+	listenerLock       sync.Mutex
+	generation         uint32
+	dials              *hashmap.HM // pending outbound connections, fd -> *dialing
+	dialCount          int32
+	SSLCtx             *sslCtx
 	IsSSL              bool
 	Threads            int
 	QueueLength        int
@@ -79,30 +119,75 @@ type EP struct {
 	KeepAlive          int
 	ReuseAddr          int
 	ReusePort          int
-	bufferPool         *pool.Pool               // []byte pool, return *[]byte
-	connPool           *pool.Pool               // Conn pool, return *Conn
-	requestPool        *pool.Pool               // *Request pool, return *Request
-	sslPool            *pool.Pool               // *C.SSL pool, return *C.SSL
+	V6Only             int
+	HandshakeTimeout   int
+	IdleTimeout        int
+	Codec              Codec
+	MaxFrameSize       int
+	LowWatermark       int
+	HighWatermark      int
+	bufferPool         *pool.Pool // []byte pool, return *[]byte
+	connPool           *pool.Pool // Conn pool, return *Conn
+	requestPool        *pool.Pool // *Request pool, return *Request
+	sslPool            *pool.Pool // *SSL pool, return *SSL
+	MaxPendingReads    int
+	MaxInflight        int
+	pausedCount        int32
+	metrics            metrics
 	threadPoolSequence *threadpool.PoolSequence // thread pool sequence
-	OnAccept           OnAcceptEvent
-	OnReceive          OnReceiveEvent
-	OnEpollOut         OnEpollOutEvent
-	OnClose            OnCloseEvent
-	OnError            OnErrorEvent
+	done               chan struct{}            // closed by Stop
+	stopOnce           sync.Once
+	stopLock           sync.Mutex     // orders loops.Add before the Wait of stop
+	loops              sync.WaitGroup // running event loops and the ticket key rotation
+	reactors           []*reactor     // event loops, the first one owns Epfd
+	reactorCursor      uint32
+	ReactorMode        int
+	inflight           int64 // requests queued or running in the thread pool
+	workersStopped     int32
+	draining           int32 // set by Shutdown, connections are no longer read
+	trimOnce           sync.Once
+
+	MaxConnectionsPerIP int
+	ipFilter            atomic.Value // *ipFilter
+	ipCounts            map[[16]byte]int
+	ipLock              sync.Mutex
+	ProxyProtocol       bool
+	sslOptions          sslOptions
+	protocolCallbacks   map[string]*Callbacks // by ALPN protocol
+	sslContext          *sslContext           // of the listener started by StartSSL
+	CertWatchInterval   int
+
+	Callbacks
 }
 
-func (ep *EP) newSSLPool(capacity int) *pool.Pool {
-	return pool.NewWithId(capacity, func(id uint64) interface{} {
+func (ep *EP) newSSLPool(sc *sslContext, capacity int) *pool.Pool {
+	var p *pool.Pool
+	p = pool.NewWithId(capacity, func(id uint64) interface{} {
+		ep.metrics.sslPool.alloc()
+		sc.use.RLock()
+		defer sc.use.RUnlock()
+		var ctx = sc.get()
 		var ssl = &SSL{
-			Id:  id,
-			SSL: C.SSL_new(ep.SSLCtx),
+			Id:   id,
+			SSL:  newSSLHandle(ctx),
+			ctx:  ctx,
+			pool: p,
 		}
 		return ssl
 	})
+	p.RecycleUpdateFunc = sslRecycleUpdate
+	p.EnableRecycle()
+	return p
+}
+
+// for a pool dropped by a failed start before its listener accepted anything, stops its recycle goroutine
+func closeSSLPool(p *pool.Pool) {
+	p.DisableRecycle()
 }
 
-func (ep *EP) getSSL() *SSL {
-	var ssl, err = ep.sslPool.Get()
+func (ep *EP) getSSL(p *pool.Pool) *SSL {
+	var ssl, err = p.Get()
+	ep.metrics.sslPool.get(err)
 	if err == nil {
 		return ssl.(*SSL)
 	}
@@ -110,47 +195,46 @@ func (ep *EP) getSSL() *SSL {
 }
 
 func (ep *EP) putSSL(ssl *SSL) {
-	C.SSL_clear(ssl.SSL)
-	ep.sslPool.PutWithId(ssl, ssl.Id)
+	clearSSLHandle(ssl.SSL)
+	ssl.pool.PutWithId(ssl, ssl.Id)
 }
 
-func newSSLCtx(certFile string, keyFile string) *C.SSL_CTX {
-	// var cret C.int = C.OPENSSL_init_ssl(C.OPENSSL_INIT_LOAD_SSL_STRINGS|C.OPENSSL_INIT_LOAD_CRYPTO_STRINGS, nil)
-	var cret C.int = C.OPENSSL_init_ssl(0, nil)
-	if cret <= 0 {
-		panic(errors.New("unable to init SSL"))
-	}
-
-	var method = C.SSLv23_server_method()
-	var ctx = C.SSL_CTX_new(method)
-	if ctx == nil {
-		panic(errors.New("unable to create SSL context"))
-	}
-
-	C.SSL_CTX_ctrl(ctx, C.SSL_CTRL_MODE, C.SSL_MODE_AUTO_RETRY, C.NULL)
-
-	var ccertp = C.CString(certFile)
-	var ckeyp = C.CString(keyFile)
-
-	defer C.free(unsafe.Pointer(ccertp))
-	defer C.free(unsafe.Pointer(ckeyp))
-
-	if C.SSL_CTX_use_certificate_file(ctx, ccertp, C.SSL_FILETYPE_PEM) <= 0 {
-		panic(errors.New("unable to set certificate"))
-	}
-
-	if C.SSL_CTX_use_PrivateKey_file(ctx, ckeyp, C.SSL_FILETYPE_PEM) <= 0 {
-		panic(errors.New("unable to set private key"))
-	}
+// pools switch to queue mode and C heap is trimmed periodically once SSL is in use
+func (ep *EP) enableSSL(sslPool *pool.Pool) {
+	sslPool.EnableQueue()
+	ep.trimOnce.Do(func() {
+		ep.bufferPool.EnableQueue()
+		ep.connPool.EnableQueue()
+		ep.requestPool.EnableQueue()
+		cMallocTrimLoop()
+	})
+}
 
-	return ctx
+// settings applied to the SSL contexts of a listener, including those of SNI names,
+// copied when the listener is started and reused by its reloads
+type sslOptions struct {
+	verify  *SSLVerify
+	alpn    []string // see SetALPN
+	config  *SSLConfig
+	tickets *sessionTickets
+	ktls    bool
 }
 
-func (ep *EP) freeSSLCtx() {
-	if ep.SSLCtx != nil {
-		C.SSL_CTX_free(ep.SSLCtx)
-		ep.SSLCtx = nil
+// contexts may be shared by several listeners, e.g. ep.SSLCtx and the listener created by StartSSL
+func (ep *EP) freeSSLCtxs() {
+	var l *Listener
+	var freed = make(map[*sslCtx]bool)
+	for _, l = range ep.getListeners() {
+		if l.SSLCtx != nil && !freed[l.SSLCtx] {
+			freeSSLCtx(l.SSLCtx)
+			freed[l.SSLCtx] = true
+		}
+		l.SSLCtx = nil
+	}
+	if ep.SSLCtx != nil && !freed[ep.SSLCtx] {
+		freeSSLCtx(ep.SSLCtx)
 	}
+	ep.SSLCtx = nil
 }
 
 func (ep *EP) GetConnectionSSL(fd int) *SSL {
@@ -179,37 +263,51 @@ func (ep *EP) GetConnectionSequenceIdAndSSL(fd int) (int, *SSL) {
 	return sequenceId, ssl
 }
 
-func (ep *EP) newSSL(fd int) *SSL {
-	var ssl = ep.getSSL()
+func (ep *EP) newSSL(l *Listener, fd int) *SSL {
+	var ssl = ep.getSSL(l.sslPool)
 	if ssl == nil {
 		return nil
 	}
-	if C.SSL_set_fd(ssl.SSL, (C.int)(fd)) <= 0 {
-		ep.putSSL(ssl)
+	// objects created before ReloadCertificates are replaced, they would keep the old context for session and SNI lookups
+	var sc = l.sslContext
+	sc.use.RLock()
+	var ctx = sc.get()
+	if ssl.ctx != ctx {
+		freeSSL(ssl)
+		ssl.SSL = newSSLHandle(ctx)
+		ssl.ctx = ctx
+	} else {
+		resetSSLCtx(ssl.SSL, ctx)
+	}
+	sc.use.RUnlock()
+	if ssl.SSL == nil {
+		ssl.ctx = nil
+		ssl.pool.PutWithId(ssl, ssl.Id)
 		return nil
 	}
-	if C.SSL_accept(ssl.SSL) <= 0 {
+	if !setSSLFd(ssl.SSL, fd) {
 		ep.putSSL(ssl)
 		return nil
 	}
 	return ssl
 }
 
+// SSL is only changed under both outLock and sslLock, the event loop may still be using it
 func (ep *EP) putConnSSL(conn *Conn) {
+	conn.outLock.Lock()
+	conn.sslLock.Lock()
 	if conn.SSL != nil {
 		ep.putSSL(conn.SSL)
 		conn.SSL = nil
+		// handles are stale from here on, send must not write to the socket without TLS
+		conn.Generation = 0
 	}
+	conn.sslLock.Unlock()
+	conn.outLock.Unlock()
 }
 
 func (ep *EP) AddConnectionSSL(fd int, ssl *SSL, sequenceId int) {
-	var conn = ep.getConn()
-	conn.Fd = fd
-	conn.SSL = ssl
-	conn.SequenceId = sequenceId
-	conn.Timestamp = time.Now().Unix()
-	conn.Status = 0
-	ep.Connections.Put(fd, conn)
+	ep.Connections.Put(fd, ep.newConnection(fd, ssl, sequenceId))
 }
 
 func (ep *EP) setConnectionSSL(fd int, ssl *SSL) bool {
@@ -226,10 +324,6 @@ func (ep *EP) setConnectionSSL(fd int, ssl *SSL) bool {
 	return ok
 }
 
-func GetSSLErrorNumber(ssl *C.SSL, ret int) int {
-	return int(C.SSL_get_error(ssl, (C.int)(ret)))
-}
-
 func GetSSLError(errno int) error {
 	switch errno {
 	case SSL_ERROR_NONE:
@@ -252,18 +346,9 @@ func GetSSLError(errno int) error {
 	return ErrorSSLUnknow
 }
 
-func sslRead(ssl *C.SSL, buffer []byte, n int) int {
-	return int(C.SSL_read(ssl, unsafe.Pointer(&buffer[0]), (C.int)(n)))
-}
-
-func sslWrite(ssl *C.SSL, buffer []byte, n int) (int, int) {
-	var ret = int(C.SSL_write(ssl, unsafe.Pointer(&buffer[0]), (C.int)(n)))
-	return ret, GetSSLErrorNumber(ssl, ret)
-}
-
 func freeSSL(ssl *SSL) {
 	if ssl.SSL != nil {
-		C.SSL_free(ssl.SSL)
+		freeSSLHandle(ssl.SSL)
 		ssl.SSL = nil
 	}
 }
@@ -274,18 +359,3 @@ func sslRecycleUpdate(ptr interface{}) {
 		freeSSL(ssl)
 	}
 }
-
-func cMallocTrimLoop() {
-	go func() {
-		var timer = time.NewTicker(DEFAULT_C_MALLOC_TRIM_INTERVAL * time.Second)
-		defer timer.Stop()
-		for {
-			<-timer.C
-			cMallocTrim()
-		}
-	}()
-}
-
-func cMallocTrim() {
-	C.malloc_trim(0)
-}
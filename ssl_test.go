@@ -0,0 +1,276 @@
+package epoll
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a CA issuing server and client certificates into a temporary directory
+type testPKI struct {
+	dir    string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	caFile string
+	serial int64
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	var p = &testPKI{dir: t.TempDir(), serial: 1}
+	var key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var template = &x509.Certificate{
+		SerialNumber:          big.NewInt(p.serial),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	var der []byte
+	if der, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key); err != nil {
+		t.Fatal(err)
+	}
+	if p.ca, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	p.caKey = key
+	p.caFile = p.write(t, "ca.crt", "CERTIFICATE", der)
+	return p
+}
+
+// returns the certificate and key files, client certificates are issued for client authentication
+func (p *testPKI) issue(t *testing.T, name string, dnsNames []string, client bool) (string, string, *x509.Certificate) {
+	var key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.serial++
+	var template = &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	var der, keyDER []byte
+	if der, err = x509.CreateCertificate(rand.Reader, template, p.ca, &key.PublicKey, p.caKey); err != nil {
+		t.Fatal(err)
+	}
+	if keyDER, err = x509.MarshalECPrivateKey(key); err != nil {
+		t.Fatal(err)
+	}
+	var cert *x509.Certificate
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return p.write(t, name+".crt", "CERTIFICATE", der), p.write(t, name+".key", "EC PRIVATE KEY", keyDER), cert
+}
+
+// a CRL of the CA revoking certs
+func (p *testPKI) crl(t *testing.T, name string, certs ...*x509.Certificate) string {
+	var revoked []x509.RevocationListEntry
+	var cert *x509.Certificate
+	for _, cert = range certs {
+		revoked = append(revoked, x509.RevocationListEntry{SerialNumber: cert.SerialNumber, RevocationTime: time.Now().Add(-time.Minute)})
+	}
+	var der, err = x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now().Add(-time.Hour),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: revoked,
+	}, p.ca, p.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.write(t, name, "X509 CRL", der)
+}
+
+func (p *testPKI) write(t *testing.T, name string, blockType string, der []byte) string {
+	var file = filepath.Join(p.dir, name)
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func (p *testPKI) pool() *x509.CertPool {
+	var roots = x509.NewCertPool()
+	roots.AddCert(p.ca)
+	return roots
+}
+
+// echoes what it receives
+func newEchoEP(t *testing.T) *EP {
+	var ep = newTestEP(t)
+	ep.OnReceive = func(fd int, msg []byte, n int) {
+		ep.Send(fd, msg[:n])
+	}
+	return ep
+}
+
+func dialTLS(t *testing.T, addr string, config *tls.Config) (*tls.Conn, error) {
+	var dialer = &net.Dialer{Timeout: testTimeout}
+	var c, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+	if err == nil {
+		c.SetDeadline(time.Now().Add(testTimeout))
+	}
+	return c, err
+}
+
+func echo(t *testing.T, c net.Conn, msg string) {
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	var buf = make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("echoed %q, want %q", buf, msg)
+	}
+}
+
+func TestSSLHandshake(t *testing.T) {
+	var p = newTestPKI(t)
+	var certFile, keyFile, _ = p.issue(t, "server", []string{"localhost"}, false)
+
+	var ep = newEchoEP(t)
+	var accepted int32
+	ep.OnAccept = func(fd int) { atomic.AddInt32(&accepted, 1) }
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListenerSSL("127.0.0.1", 0, certFile, keyFile, nil)
+	})
+
+	var c, err = dialTLS(t, addr, &tls.Config{ServerName: "localhost", RootCAs: p.pool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echo(t, c, "hello over TLS")
+	// a record larger than the read buffer
+	echo(t, c, string(make([]byte, 64<<10)))
+
+	waitUntil(t, "OnAccept", func() bool { return atomic.LoadInt32(&accepted) == 1 })
+	if n := ep.Stats().Handshakes; n != 1 {
+		t.Fatalf("%d handshakes, want 1", n)
+	}
+}
+
+func TestSSLHandshakeTimeout(t *testing.T) {
+	var p = newTestPKI(t)
+	var certFile, keyFile, _ = p.issue(t, "server", []string{"localhost"}, false)
+
+	var ep = newEchoEP(t)
+	ep.SetHandshakeTimeout(1)
+	ep.OnAccept = func(fd int) { t.Errorf("OnAccept before the handshake completed") }
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListenerSSL("127.0.0.1", 0, certFile, keyFile, nil)
+	})
+
+	var c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// the start of a handshake record, the rest never comes
+	c.Write([]byte{0x16, 0x03, 0x01})
+	c.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, err = c.Read(make([]byte, 16)); err == nil {
+		t.Fatal("read data from a connection whose handshake timed out")
+	}
+	waitUntil(t, "the handshake timeout", func() bool { return ep.Stats().HandshakeTimeouts == 1 })
+}
+
+func TestSSLHandshakeFailure(t *testing.T) {
+	var p = newTestPKI(t)
+	var certFile, keyFile, _ = p.issue(t, "server", []string{"localhost"}, false)
+
+	var ep = newEchoEP(t)
+	var failed = make(chan ErrorCode, 1)
+	ep.OnError = func(fd int, code ErrorCode, err error) { failed <- code }
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListenerSSL("127.0.0.1", 0, certFile, keyFile, nil)
+	})
+
+	var c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// a plaintext request instead of a ClientHello
+	c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	select {
+	case code := <-failed:
+		if code != ERROR_SSL_HANDSHAKE {
+			t.Fatalf("error code %d, want ERROR_SSL_HANDSHAKE", code)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for the handshake to fail")
+	}
+}
+
+// writes in small pieces with pauses, so the server reads each TLS record in several parts
+type slowConn struct {
+	net.Conn
+}
+
+func (c slowConn) Write(b []byte) (int, error) {
+	var written int
+	for written < len(b) {
+		var end = written + 50
+		if end > len(b) {
+			end = len(b)
+		}
+		var n, err = c.Conn.Write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return written, nil
+}
+
+// the handshake stops for lack of data many times and resumes on the next read event
+func TestSSLHandshakeSlowClient(t *testing.T) {
+	var p = newTestPKI(t)
+	var certFile, keyFile, _ = p.issue(t, "server", []string{"localhost"}, false)
+
+	var ep = newEchoEP(t)
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListenerSSL("127.0.0.1", 0, certFile, keyFile, nil)
+	})
+
+	var c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(testTimeout))
+	var tc = tls.Client(slowConn{c}, &tls.Config{ServerName: "localhost", RootCAs: p.pool()})
+	if err = tc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	echo(t, tc, string(make([]byte, 1000)))
+}
@@ -0,0 +1,86 @@
+package epoll
+
+import (
+	"time"
+)
+
+const (
+	TLS_VERSION_1_0 = 0x0301
+	TLS_VERSION_1_1 = 0x0302
+	TLS_VERSION_1_2 = 0x0303
+	TLS_VERSION_1_3 = 0x0304
+)
+
+// zero values keep the defaults of the TLS backend
+// the crypto/tls backend takes Ciphers and Groups as colon separated names, always enables its TLS 1.3 suites,
+// so CipherSuites is only checked for valid TLS 1.3 names, and ignores SessionCacheSize and SessionTimeout
+type SSLConfig struct {
+	MinVersion            int    // e.g. TLS_VERSION_1_2
+	MaxVersion            int    // e.g. TLS_VERSION_1_3
+	Ciphers               string // TLS 1.2 and below, in OpenSSL cipher list format, e.g. "ECDHE+AESGCM:ECDHE+CHACHA20"
+	CipherSuites          string // TLS 1.3, e.g. "TLS_AES_256_GCM_SHA384:TLS_CHACHA20_POLY1305_SHA256"
+	Groups                string // ECDH groups, e.g. "X25519:P-256"
+	PreferServerCiphers   bool   // OpenSSL only, crypto/tls picks the suite on its own
+	SessionCacheSize      int    // sessions kept for resumption by session ID, -1 disables the cache
+	SessionTimeout        int    // seconds a session or ticket can be resumed
+	DisableSessionTickets bool
+	TicketKeyRotation     int // seconds between new ticket keys, tickets of the previous key are still accepted
+}
+
+// used by the TLS listeners started afterwards, a certificate reload keeps the config of its listener,
+// invalid settings are reported by StartSSL and AddListenerSSL with ErrorSSLConfig
+// c is copied, changing it afterwards has no effect
+func (ep *EP) SetSSLConfig(c *SSLConfig) error {
+	if c == nil {
+		ep.sslOptions.config = nil
+		return nil
+	}
+	var config = *c
+	ep.sslOptions.config = &config
+	if c.TicketKeyRotation <= 0 || c.DisableSessionTickets {
+		return nil
+	}
+	if ep.sslOptions.tickets == nil {
+		var tickets, err = newSessionTickets()
+		if err != nil {
+			return err
+		}
+		ep.sslOptions.tickets = tickets
+	}
+	return nil
+}
+
+// runs while the EP is listening, counted in loops so Stop waits for it before releasing the keys
+func (ep *EP) ticketLoop() {
+	var tickets = ep.sslOptions.tickets
+	var c = ep.sslOptions.config
+	if tickets == nil || c == nil || c.TicketKeyRotation <= 0 {
+		return
+	}
+	// addLoops has already counted the event loops, which have not started yet, so Wait cannot have returned
+	ep.loops.Add(1)
+	go func() {
+		defer ep.loops.Done()
+		var timer = time.NewTicker(time.Duration(c.TicketKeyRotation) * time.Second)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ep.done:
+				return
+			case <-timer.C:
+				if err := tickets.rotate(); err != nil {
+					ep.reportError(-1, -1, ERROR_SSL_TICKET_KEY, err)
+				}
+			}
+		}
+	}()
+}
+
+// the keys are freed once the last context using them is freed as well,
+// a later SetSSLConfig creates new ones instead of handing the released keys to new listeners
+func (ep *EP) releaseTickets() {
+	if ep.sslOptions.tickets != nil {
+		ep.sslOptions.tickets.release()
+		ep.sslOptions.tickets = nil
+	}
+}
@@ -0,0 +1,157 @@
+package epoll
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+)
+
+// tickets of the current and the previous key resume the session, older ones fall back to a full handshake
+func TestTicketKeyRotation(t *testing.T) {
+	var p = newTestPKI(t)
+	var certFile, keyFile, _ = p.issue(t, "server", []string{"localhost"}, false)
+
+	var ep = newEchoEP(t)
+	// rotated by the test instead
+	if err := ep.SetSSLConfig(&SSLConfig{TicketKeyRotation: 3600}); err != nil {
+		t.Fatal(err)
+	}
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListenerSSL("127.0.0.1", 0, certFile, keyFile, nil)
+	})
+
+	var config = &tls.Config{ServerName: "localhost", RootCAs: p.pool(), ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+	var resumed = func() bool {
+		var c, err = dialTLS(t, addr, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		// TLS 1.3 tickets arrive after the handshake
+		echo(t, c, "hello")
+		return c.ConnectionState().DidResume
+	}
+
+	if resumed() {
+		t.Fatal("first connection resumed")
+	}
+	if !resumed() {
+		t.Fatal("not resumed with a ticket of the current key")
+	}
+	if err := ep.sslOptions.tickets.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if !resumed() {
+		t.Fatal("not resumed with a ticket of the previous key")
+	}
+	var i int
+	for i = 0; i < 2; i++ {
+		if err := ep.sslOptions.tickets.rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if resumed() {
+		t.Fatal("resumed with a ticket of a retired key")
+	}
+}
+
+func TestDisableSessionTickets(t *testing.T) {
+	var p = newTestPKI(t)
+	var certFile, keyFile, _ = p.issue(t, "server", []string{"localhost"}, false)
+
+	var ep = newEchoEP(t)
+	if err := ep.SetSSLConfig(&SSLConfig{DisableSessionTickets: true, SessionCacheSize: -1}); err != nil {
+		t.Fatal(err)
+	}
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListenerSSL("127.0.0.1", 0, certFile, keyFile, nil)
+	})
+
+	var config = &tls.Config{ServerName: "localhost", RootCAs: p.pool(), ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+	var i int
+	for i = 0; i < 2; i++ {
+		var c, err = dialTLS(t, addr, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo(t, c, "hello")
+		if c.ConnectionState().DidResume {
+			t.Fatalf("connection %d resumed without tickets", i)
+		}
+		c.Close()
+	}
+}
+
+func TestSSLConfigInvalid(t *testing.T) {
+	var p = newTestPKI(t)
+	var certFile, keyFile, _ = p.issue(t, "server", []string{"localhost"}, false)
+
+	var tests = []struct {
+		name string
+		c    SSLConfig
+	}{
+		{"unknown version", SSLConfig{MinVersion: 0x0305}},
+		{"min above max", SSLConfig{MinVersion: TLS_VERSION_1_3, MaxVersion: TLS_VERSION_1_2}},
+		{"unknown cipher suite", SSLConfig{CipherSuites: "TLS_NOPE"}},
+		{"TLS 1.2 cipher as suite", SSLConfig{CipherSuites: "ECDHE-RSA-AES128-GCM-SHA256"}},
+		{"unknown group", SSLConfig{Groups: "nope"}},
+	}
+	for _, tt := range tests {
+		var ep = newTestEP(t)
+		if err := ep.SetSSLConfig(&tt.c); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ep.AddListenerSSL("127.0.0.1", 0, certFile, keyFile, nil); !errors.Is(err, ErrorSSLConfig) {
+			t.Errorf("%s: error %v, want ErrorSSLConfig", tt.name, err)
+		}
+	}
+}
+
+// the config is copied, changing it afterwards does not reach the listeners
+func TestSSLConfigCopied(t *testing.T) {
+	var p = newTestPKI(t)
+	var certFile, keyFile, _ = p.issue(t, "server", []string{"localhost"}, false)
+
+	var ep = newEchoEP(t)
+	var c = &SSLConfig{MinVersion: TLS_VERSION_1_2}
+	if err := ep.SetSSLConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	c.MinVersion = 0x0305
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListenerSSL("127.0.0.1", 0, certFile, keyFile, nil)
+	})
+
+	var tc, err = dialTLS(t, addr, &tls.Config{ServerName: "localhost", RootCAs: p.pool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	echo(t, tc, "hello")
+}
+
+// Stop releases the ticket keys once their rotation has ended, a new config gets new keys
+func TestSSLConfigTicketsReleased(t *testing.T) {
+	var ep = newTestEP(t)
+	if err := ep.SetSSLConfig(&SSLConfig{TicketKeyRotation: 3600}); err != nil {
+		t.Fatal(err)
+	}
+	var tickets = ep.sslOptions.tickets
+	var done = make(chan struct{})
+	go func() {
+		ep.Listen()
+		close(done)
+	}()
+	ep.Stop()
+	<-done
+	if ep.sslOptions.tickets != nil {
+		t.Fatal("released ticket keys still set")
+	}
+	if err := ep.SetSSLConfig(&SSLConfig{TicketKeyRotation: 3600}); err != nil {
+		t.Fatal(err)
+	}
+	if ep.sslOptions.tickets == nil || ep.sslOptions.tickets == tickets {
+		t.Fatal("no new ticket keys after Stop")
+	}
+	ep.releaseTickets()
+}
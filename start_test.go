@@ -0,0 +1,115 @@
+package epoll
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// start failures are returned as *StartError instead of panicking, and the EP stays usable
+func TestStartError(t *testing.T) {
+	var ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var port = ln.Addr().(*net.TCPAddr).Port
+	var missing = filepath.Join(t.TempDir(), "missing.pem")
+
+	var tests = []struct {
+		name  string
+		start func(ep *EP) error
+		op    string
+		err   error
+	}{
+		{"port in use", func(ep *EP) error { return ep.Start("127.0.0.1", port) }, "listen", unix.EADDRINUSE},
+		{"invalid host", func(ep *EP) error { return ep.Start("localhost", 0) }, "listen", nil},
+		{"missing certificate", func(ep *EP) error { return ep.StartSSL("127.0.0.1", 0, missing, missing) }, "ssl", ErrorSSLCertificate},
+		{"listener port in use", func(ep *EP) error {
+			var _, err = ep.AddListener("127.0.0.1", port, nil)
+			return err
+		}, "listen", unix.EADDRINUSE},
+	}
+	for _, tt := range tests {
+		var ep = newTestEP(t)
+		var err = tt.start(ep)
+		var se *StartError
+		if !errors.As(err, &se) {
+			t.Errorf("%s: error %v, want a *StartError", tt.name, err)
+			continue
+		}
+		if se.Op != tt.op {
+			t.Errorf("%s: op %q, want %q", tt.name, se.Op, tt.op)
+		}
+		if tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+		}
+		if n := len(ep.getListeners()); n != 0 {
+			t.Errorf("%s: %d listeners left", tt.name, n)
+		}
+		// the failed start left nothing behind that keeps the EP from serving
+		var addr = serveTest(t, ep, func() (*Listener, error) {
+			return ep.AddListener("127.0.0.1", 0, nil)
+		})
+		var c net.Conn
+		if c, err = net.Dial("tcp", addr); err != nil {
+			t.Errorf("%s: dial after the failed start: %v", tt.name, err)
+			continue
+		}
+		c.Close()
+	}
+}
+
+// Run returns ctx.Err() when ctx stops the EP and nil when Stop does
+func TestRun(t *testing.T) {
+	var tests = []struct {
+		name   string
+		cancel bool
+		err    error
+	}{
+		{"canceled", true, context.Canceled},
+		{"stopped", false, nil},
+	}
+	for _, tt := range tests {
+		var ep = newTestEP(t)
+		var l, err = ep.AddListener("127.0.0.1", 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var addr = listenerAddr(t, l)
+		var ctx, cancel = context.WithCancel(context.Background())
+		var done = make(chan error, 1)
+		go func() {
+			done <- ep.Run(ctx)
+		}()
+		var c net.Conn
+		if c, err = net.Dial("tcp", addr); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+
+		if tt.cancel {
+			cancel()
+		} else {
+			ep.Stop()
+		}
+		select {
+		case err = <-done:
+			if err != tt.err {
+				t.Errorf("%s: Run returned %v, want %v", tt.name, err, tt.err)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("%s: Run did not return", tt.name)
+		}
+		cancel()
+		if c, err = net.Dial("tcp", addr); err == nil {
+			c.Close()
+			t.Errorf("%s: listener still open after Run returned", tt.name)
+		}
+	}
+}
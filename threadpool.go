@@ -1,32 +1,74 @@
 package epoll
 
 import (
+	"runtime"
+	"sync/atomic"
+
 	"github.com/wuyongjia/threadpool"
 )
 
 func (ep *EP) newThreadPoolSequence() *threadpool.PoolSequence {
 	var p = threadpool.NewSequenceWithFunc(ep.Threads, ep.QueueLength, func(payload interface{}) {
+		if _, ok := payload.(workerStop); ok {
+			// the worker loop of the thread pool has no way out, closing its channel would make it spin
+			runtime.Goexit()
+		}
 		var req, ok = payload.(*Request)
 		if ok {
+			var cb, id = req.Callbacks, req.ConnID
 			switch req.Op {
 			case OP_ACCEPT:
-				ep.accept(req.SequenceId)
+				ep.accept(req.Listener, req.SequenceId)
 			case OP_RECEIVE:
-				ep.OnReceive(req.Fd, req.Msg[:req.N], req.N)
+				if ep.Codec != nil && cb.hasMessage() {
+					ep.decode(req.SequenceId, id, cb, req.Msg[:req.N])
+				} else {
+					cb.receive(id, req.Msg[:req.N], req.N)
+				}
 				ep.PutBuffer(&req.Msg)
+				if ep.MaxPendingReads > 0 {
+					ep.receiveDone(id)
+				}
+			case OP_ACCEPTED:
+				cb.accept(id)
+			case OP_CONNECT:
+				cb.connect(id)
+			case OP_DRAIN:
+				cb.drain(id)
+			case OP_IDLE:
+				cb.idle(id)
+			case OP_SENDFILE:
+				cb.sendFile(id, req.File, req.Sent, req.Err)
 			case OP_EPOLLOUT:
-				ep.OnEpollOut(req.Fd)
+				cb.epollOut(id)
 			case OP_CLOSE:
-				ep.DeleteConnection(req.Fd)
-				ep.CloseFd(req.Fd)
-				if ep.OnClose != nil {
-					ep.OnClose(req.Fd)
+				// CloseAll of Stop may have closed the fd already, its number could belong to someone else by now
+				if ep.DeleteConnection(req.Fd) {
+					ep.CloseFd(req.Fd)
 				}
+				cb.close(id)
 			case OP_ERROR:
-				ep.OnError(req.Fd, req.ErrCode, req.Err)
+				cb.error(id, req.ErrCode, req.Err)
 			}
 			ep.putRequest(req)
+			ep.requestDone(atomic.AddInt64(&ep.inflight, -1))
 		}
 	})
 	return p
 }
+
+// queued after the requests already waiting, so every worker finishes those first and then exits
+type workerStop struct{}
+
+// runs at the end of Stop, requests invoked afterwards are dropped
+func (ep *EP) stopThreadPool() {
+	atomic.StoreInt32(&ep.workersStopped, 1)
+	var p = ep.threadPoolSequence
+	// not on the caller, Stop may run on a worker whose own queue is full
+	go func() {
+		var i int
+		for i = range p.ArgsList {
+			p.Invoke(i, workerStop{})
+		}
+	}()
+}
@@ -0,0 +1,119 @@
+package epoll
+
+import (
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// path starting with "@" binds to the abstract namespace, an existing socket file is only replaced when nothing listens on it
+// sockType is unix.SOCK_STREAM or unix.SOCK_SEQPACKET, a SEQPACKET message larger than ReadBuffer fails the connection
+// with ErrorMessageTruncated, empty messages are skipped
+func (ep *EP) StartUnix(path string, sockType int) error {
+	var err error
+	if err = ep.InitEpollUnix(path, sockType); err != nil {
+		return err
+	}
+	ep.listen()
+	return nil
+}
+
+func (ep *EP) InitEpollUnix(path string, sockType int) error {
+	var n, fd = len(ep.getListeners()), ep.getListenFd()
+	var l, err = ep.newUnixListener(path, sockType)
+	if err != nil {
+		return newStartError("listen", path, err)
+	}
+	ep.setListenFd(l.Fd)
+	ep.Family = l.Family
+	ep.Path = l.Path
+	if err = ep.addListener(l); err != nil {
+		ep.removeListenersFrom(n)
+		ep.setListenFd(fd)
+		return newStartError("listen", path, err)
+	}
+	return nil
+}
+
+func (ep *EP) newUnixListener(path string, sockType int) (*Listener, error) {
+	var err error
+	var fd int
+
+	if !isAbstractPath(path) {
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 && isStaleSocket(path, sockType) {
+			unix.Unlink(path)
+		}
+	}
+
+	if fd, err = unix.Socket(unix.AF_UNIX, unix.O_NONBLOCK|sockType, 0); err != nil {
+		return nil, err
+	}
+
+	if err = unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	if err = bindListener(fd, &unix.SockaddrUnix{Name: path}); err != nil {
+		return nil, err
+	}
+
+	return &Listener{Fd: fd, Family: unix.AF_UNIX, Path: path, ProxyProtocol: ep.ProxyProtocol}, nil
+}
+
+func (l *Listener) unlinkUnixPath() {
+	if l.Family == unix.AF_UNIX && l.Path != "" && !isAbstractPath(l.Path) {
+		unix.Unlink(l.Path)
+	}
+}
+
+func isAbstractPath(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// left behind by a process that is gone, a socket another process still listens on makes bind fail instead
+func isStaleSocket(path string, sockType int) bool {
+	var fd, err = unix.Socket(unix.AF_UNIX, sockType|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return false
+	}
+	defer unix.Close(fd)
+	return unix.Connect(fd, &unix.SockaddrUnix{Name: path}) == unix.ECONNREFUSED
+}
+
+// SO_PASSCRED lets readPacket tell an empty message from the end of the stream,
+// without it the connection is read like a stream and an empty message closes it
+func isSeqPacket(fd int) bool {
+	var sockType, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+	if err != nil || sockType != unix.SOCK_SEQPACKET {
+		return false
+	}
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_PASSCRED, 1) == nil
+}
+
+// reads one message, an empty message reads 0 bytes like the end of the stream, eof tells them apart:
+// with SO_PASSCRED every message carries the credentials of its sender, the end of the stream carries none
+func readPacket(fd int, buf []byte) (int, bool, error) {
+	var oob [64]byte
+	var n, oobn, flags, _, err = unix.Recvmsg(fd, buf, oob[:], 0)
+	if err != nil {
+		return n, false, err
+	}
+	if flags&unix.MSG_TRUNC != 0 {
+		return n, false, ErrorMessageTruncated
+	}
+	return n, n == 0 && oobn == 0, nil
+}
+
+// pid, uid and gid of the peer process, only for AF_UNIX connections
+func (ep *EP) GetConnectionPeerCred(fd int) (*unix.Ucred, bool) {
+	var cred *unix.Ucred
+	ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+		var c, ok = value.(*Conn)
+		if ok {
+			cred = c.Cred
+		}
+	})
+	return cred, cred != nil
+}
@@ -0,0 +1,51 @@
+package epoll
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// empty messages are skipped and do not end the stream, also when the peer closes right after them
+func TestSeqPacketEmptyMessages(t *testing.T) {
+	var ep = newTestEP(t)
+	var received = make(chan string, 4)
+	var closed = make(chan struct{}, 1)
+	ep.OnReceive = func(fd int, msg []byte, n int) { received <- string(msg[:n]) }
+	ep.OnClose = func(fd int) { closed <- struct{}{} }
+	var path = filepath.Join(t.TempDir(), "seqpacket.sock")
+	serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListenerUnix(path, unix.SOCK_SEQPACKET, nil)
+	})
+
+	var fd, err = unix.Socket(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = unix.Connect(fd, &unix.SockaddrUnix{Name: path}); err != nil {
+		unix.Close(fd)
+		t.Fatal(err)
+	}
+	var msg string
+	for _, msg = range []string{"", "", "a", "", "b"} {
+		if _, err = unix.Write(fd, []byte(msg)); err != nil {
+			unix.Close(fd)
+			t.Fatal(err)
+		}
+	}
+	unix.Close(fd)
+
+	var want string
+	for _, want = range []string{"a", "b"} {
+		if s := receive(t, "OnReceive", received); s != want {
+			t.Fatalf("received %q, want %q", s, want)
+		}
+	}
+	select {
+	case <-closed:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for OnClose")
+	}
+}
@@ -34,9 +34,16 @@ func WriteWithTimeout(fd int, msg []byte, timeout time.Duration) (int, error) {
 }
 
 func (ep *EP) WriteSSL(fd int, msg []byte, n int) (int, int) {
-	var ssl = ep.GetConnectionSSL(fd)
-	if ssl != nil {
-		return sslWrite(ssl.SSL, msg, n)
+	var conn = ep.GetConnection(fd)
+	if conn == nil {
+		return -1, -1
+	}
+	conn.sslLock.Lock()
+	defer conn.sslLock.Unlock()
+	if conn.SSL != nil {
+		var writed, errno = sslWrite(conn.SSL.SSL, msg, n)
+		ep.countWrite(writed)
+		return writed, errno
 	}
 	return -1, -1
 }
@@ -0,0 +1,70 @@
+package epoll
+
+import (
+	"crypto/x509"
+)
+
+const (
+	SSL_VERIFY_NONE     = 0 // client certificates are not requested
+	SSL_VERIFY_OPTIONAL = 1 // requested and verified if the client sends one
+	SSL_VERIFY_REQUIRED = 2 // the handshake fails without a valid client certificate
+)
+
+// client certificate verification, CAFile is a PEM bundle, CAPath a directory prepared with c_rehash,
+// at least one of them is required unless Mode is SSL_VERIFY_NONE,
+// CRLFile is a PEM file of revocation lists, revocation is checked for the client certificate,
+// or for the whole chain with CRLCheckAll, which requires CRLFile, Depth 0 keeps the OpenSSL default
+type SSLVerify struct {
+	Mode        int
+	CAFile      string
+	CAPath      string
+	Depth       int
+	CRLFile     string
+	CRLCheckAll bool
+}
+
+// client certificates are requested by the TLS listeners started afterwards,
+// changing it later does not affect running listeners, not even when they reload their certificates
+func (ep *EP) SetSSLVerify(v *SSLVerify) {
+	ep.sslOptions.verify = v
+}
+
+// checked by both backends before anything is loaded
+func checkSSLVerify(v *SSLVerify) error {
+	if v.CAFile == "" && v.CAPath == "" {
+		return ErrorSSLNoCA
+	}
+	if v.CRLCheckAll && v.CRLFile == "" {
+		return ErrorSSLNoCRL
+	}
+	return nil
+}
+
+// DER encoded client certificate and chain, set once the handshake has completed, so it can be used in OnAccept
+func (ep *EP) GetConnectionPeerCertificatesDER(fd int) [][]byte {
+	var certs [][]byte
+	ep.Connections.UpdateWithFunc(fd, func(value interface{}) {
+		var c, ok = value.(*Conn)
+		if ok {
+			certs = c.peerCerts
+		}
+	})
+	return certs
+}
+
+func (ep *EP) GetConnectionPeerCertificates(fd int) ([]*x509.Certificate, error) {
+	return parseCertificates(ep.GetConnectionPeerCertificatesDER(fd))
+}
+
+func parseCertificates(ders [][]byte) ([]*x509.Certificate, error) {
+	var certs = make([]*x509.Certificate, 0, len(ders))
+	var der []byte
+	for _, der = range ders {
+		var cert, err = x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
@@ -0,0 +1,105 @@
+package epoll
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+)
+
+func TestCheckSSLVerify(t *testing.T) {
+	var tests = []struct {
+		name string
+		v    SSLVerify
+		err  error
+	}{
+		{"CA file", SSLVerify{Mode: SSL_VERIFY_REQUIRED, CAFile: "ca.crt"}, nil},
+		{"CA path", SSLVerify{Mode: SSL_VERIFY_OPTIONAL, CAPath: "certs"}, nil},
+		{"no CA", SSLVerify{Mode: SSL_VERIFY_REQUIRED}, ErrorSSLNoCA},
+		{"CRL", SSLVerify{Mode: SSL_VERIFY_REQUIRED, CAFile: "ca.crt", CRLFile: "ca.crl", CRLCheckAll: true}, nil},
+		{"check all without CRL", SSLVerify{Mode: SSL_VERIFY_REQUIRED, CAFile: "ca.crt", CRLCheckAll: true}, ErrorSSLNoCRL},
+	}
+	for _, tt := range tests {
+		if err := checkSSLVerify(&tt.v); err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+// client certificates revoked by the CRL fail the handshake, others are available in OnAccept
+func TestSSLVerify(t *testing.T) {
+	var p = newTestPKI(t)
+	var certFile, keyFile, _ = p.issue(t, "server", []string{"localhost"}, false)
+	var goodCert, goodKey, _ = p.issue(t, "good", nil, true)
+	var revokedCert, revokedKey, revoked = p.issue(t, "revoked", nil, true)
+	var crlFile = p.crl(t, "ca.crl", revoked)
+
+	var ep = newEchoEP(t)
+	ep.SetSSLVerify(&SSLVerify{Mode: SSL_VERIFY_REQUIRED, CAFile: p.caFile, CRLFile: crlFile})
+	var peers = make(chan string, 1)
+	ep.OnAccept = func(fd int) {
+		var certs, err = ep.GetConnectionPeerCertificates(fd)
+		if err != nil || len(certs) == 0 {
+			peers <- ""
+			return
+		}
+		peers <- certs[0].Subject.CommonName
+	}
+	var addr = serveTest(t, ep, func() (*Listener, error) {
+		return ep.AddListenerSSL("127.0.0.1", 0, certFile, keyFile, nil)
+	})
+
+	var dial = func(certFile string, keyFile string) (*tls.Conn, error) {
+		var config = &tls.Config{ServerName: "localhost", RootCAs: p.pool()}
+		if certFile != "" {
+			var pair, err = tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.Certificates = []tls.Certificate{pair}
+		}
+		return dialTLS(t, addr, config)
+	}
+
+	var c, err = dial(goodCert, goodKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, c, "hello")
+	c.Close()
+	if cn := receive(t, "OnAccept", peers); cn != "good" {
+		t.Fatalf("peer certificate %q, want good", cn)
+	}
+
+	var failures = []struct {
+		name     string
+		certFile string
+		keyFile  string
+	}{
+		{"revoked", revokedCert, revokedKey},
+		{"without a certificate", "", ""},
+	}
+	for _, f := range failures {
+		// with TLS 1.3 the client finishes its side of the handshake before the server checks the certificate
+		if c, err = dial(f.certFile, f.keyFile); err == nil {
+			if _, err = c.Write([]byte("hello")); err == nil {
+				_, err = c.Read(make([]byte, 5))
+			}
+			c.Close()
+		}
+		if err == nil {
+			t.Errorf("%s: client certificate accepted", f.name)
+		}
+	}
+	waitUntil(t, "2 handshake failures", func() bool { return ep.Stats().HandshakeFailures == 2 })
+}
+
+func TestSSLVerifyWithoutCA(t *testing.T) {
+	var p = newTestPKI(t)
+	var certFile, keyFile, _ = p.issue(t, "server", []string{"localhost"}, false)
+
+	var ep = newTestEP(t)
+	ep.SetSSLVerify(&SSLVerify{Mode: SSL_VERIFY_REQUIRED})
+	if _, err := ep.AddListenerSSL("127.0.0.1", 0, certFile, keyFile, nil); !errors.Is(err, ErrorSSLNoCA) {
+		t.Fatalf("error %v, want ErrorSSLNoCA", err)
+	}
+}